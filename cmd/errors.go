@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+	"github.com/h3ll0kitt1/avitotest/internal/validator"
+)
+
+// Стабильные коды ошибок, по которым клиенты могут определять тип ошибки независимо от текста сообщения
+const (
+	StatusValidationFailed       = "VALIDATION_FAILED"
+	StatusNotFound               = "NOT_FOUND"
+	StatusSegmentNotFound        = "SEGMENT_NOT_FOUND"
+	StatusSegmentExists          = "SEGMENT_ALREADY_EXISTS"
+	StatusSegmentArchived        = "SEGMENT_ARCHIVED"
+	StatusUserNotFound           = "USER_NOT_FOUND"
+	StatusImportNotFound         = "IMPORT_JOB_NOT_FOUND"
+	StatusConflict               = "CONFLICT"
+	StatusIdempotencyInProgress  = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	StatusIdempotencyKeyMismatch = "IDEMPOTENCY_KEY_MISMATCH"
+	StatusPayloadTooLarge        = "PAYLOAD_TOO_LARGE"
+	StatusUnknownSegments        = "UNKNOWN_SEGMENTS"
+	StatusCompositionCycle       = "COMPOSITION_CYCLE"
+	StatusCompositeSegment       = "COMPOSITE_SEGMENT"
+	StatusRateLimited            = "RATE_LIMITED"
+	StatusInternalError          = "INTERNAL_ERROR"
+	StatusServiceUnavailable     = "SERVICE_UNAVAILABLE"
+)
+
+type errorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	Code    int                  `json:"code"`
+	Status  string               `json:"status" enums:"VALIDATION_FAILED,NOT_FOUND,SEGMENT_NOT_FOUND,USER_NOT_FOUND,IMPORT_JOB_NOT_FOUND,CONFLICT,SEGMENT_ALREADY_EXISTS,SEGMENT_ARCHIVED,COMPOSITION_CYCLE,COMPOSITE_SEGMENT,IDEMPOTENCY_KEY_IN_PROGRESS,IDEMPOTENCY_KEY_MISMATCH,PAYLOAD_TOO_LARGE,UNKNOWN_SEGMENTS,RATE_LIMITED,INTERNAL_ERROR,SERVICE_UNAVAILABLE"`
+	Message string               `json:"message"`
+	Details validator.Violations `json:"details,omitempty"`
+}
+
+func (app *application) writeError(w http.ResponseWriter, code int, status string, message string, details validator.Violations) {
+	var error errorResponse
+	error.Error.Code = code
+	error.Error.Status = status
+	error.Error.Message = message
+	error.Error.Details = details
+
+	jsonErr, err := json.Marshal(error)
+	if err != nil {
+		app.logger.Errorw("error",
+			"writeError: error converting data to json", err,
+		)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(jsonErr)
+}
+
+func (app *application) errorNotFound(w http.ResponseWriter, r *http.Request) {
+	app.writeError(w, http.StatusNotFound, StatusNotFound, "Wrong resource url", nil)
+}
+
+func (app *application) errorInternalServer(w http.ResponseWriter) {
+	app.writeError(w, http.StatusInternalServerError, StatusInternalError, "Error while processing request. Please, contact support", nil)
+}
+
+func (app *application) errorUnavailable(w http.ResponseWriter) {
+	app.writeError(w, http.StatusServiceUnavailable, StatusServiceUnavailable, "Service is temporarily unavailable. Please, retry later", nil)
+}
+
+func (app *application) errorWrongFormat(w http.ResponseWriter, violations ...validator.Violation) {
+	message := "Wrong body request or url params format"
+
+	// Если известно, какие именно поля не прошли проверку, перечисляем их в сообщении и в details
+	if len(violations) != 0 {
+		messages := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			messages = append(messages, violation.Message)
+		}
+		message = strings.Join(messages, "; ")
+	}
+	app.writeError(w, http.StatusBadRequest, StatusValidationFailed, message, violations)
+}
+
+func (app *application) errorTooLarge(w http.ResponseWriter) {
+	app.writeError(w, http.StatusRequestEntityTooLarge, StatusPayloadTooLarge, "Request body or list in request is too large", nil)
+}
+
+func (app *application) errorTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	// Retry-After задается в целых секундах, поэтому округляем вверх
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.writeError(w, http.StatusTooManyRequests, StatusRateLimited, "Too many requests. Please, retry later", nil)
+}
+
+func (app *application) errorConflict(w http.ResponseWriter, status string, message string) {
+	app.writeError(w, http.StatusConflict, status, message, nil)
+}
+
+func (app *application) errorUnprocessable(w http.ResponseWriter, status string, message string, violations ...validator.Violation) {
+	app.writeError(w, http.StatusUnprocessableEntity, status, message, violations)
+}
+
+// Ошибки хранилища переводим в соответствующие коды ответа, все неизвестные ошибки считаем внутренними
+func (app *application) errorStorage(w http.ResponseWriter, err error) {
+	e := storageError(err)
+	app.writeError(w, e.Code, e.Status, e.Message, e.Details)
+}
+
+func storageError(err error) Error {
+	var (
+		unknownErr *storage.UnknownSegmentsError
+		cycleErr   *storage.CompositionCycleError
+		compErr    *storage.CompositeSegmentsError
+	)
+	switch {
+	case errors.Is(err, storage.ErrSegmentNotFound):
+		return Error{Code: http.StatusNotFound, Status: StatusSegmentNotFound, Message: "Segment not found"}
+	case errors.Is(err, storage.ErrUserNotFound):
+		return Error{Code: http.StatusNotFound, Status: StatusUserNotFound, Message: "User not found"}
+	case errors.Is(err, storage.ErrImportNotFound):
+		return Error{Code: http.StatusNotFound, Status: StatusImportNotFound, Message: "Import job not found"}
+	case errors.Is(err, storage.ErrSegmentExists):
+		return Error{Code: http.StatusConflict, Status: StatusSegmentExists, Message: "Segment with this name already exists"}
+	case errors.Is(err, storage.ErrSegmentArchived):
+		return Error{Code: http.StatusConflict, Status: StatusSegmentArchived, Message: "Segment is archived. Restore it before adding users"}
+	case errors.Is(err, storage.ErrConflict):
+		return Error{Code: http.StatusConflict, Status: StatusConflict, Message: "Request conflicts with the current state of data. Please, retry"}
+	case errors.As(err, &cycleErr):
+		return Error{Code: http.StatusConflict, Status: StatusCompositionCycle, Message: "Segment can not be part of its own composition: " + strings.Join(cycleErr.Cycle, " -> ")}
+	case errors.As(err, &compErr):
+		return Error{Code: http.StatusUnprocessableEntity, Status: StatusCompositeSegment, Message: "Users can not be added to composite segments: " + strings.Join(compErr.Slugs, ", ")}
+	case errors.As(err, &unknownErr):
+		return Error{Code: http.StatusUnprocessableEntity, Status: StatusUnknownSegments, Message: "Segments do not exist: " + strings.Join(unknownErr.Slugs, ", ")}
+	case errors.Is(err, storage.ErrInvalidData):
+		return Error{Code: http.StatusBadRequest, Status: StatusValidationFailed, Message: "Wrong body request or url params format"}
+	case errors.Is(err, storage.ErrUnavailable):
+		return Error{Code: http.StatusServiceUnavailable, Status: StatusServiceUnavailable, Message: "Service is temporarily unavailable. Please, retry later"}
+	default:
+		return Error{Code: http.StatusInternalServerError, Status: StatusInternalError, Message: "Error while processing request. Please, contact support"}
+	}
+}
+
+// Тело запроса, превысившее допустимый размер, отличаем от просто неверного формата
+func (app *application) errorRequestBody(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		app.errorTooLarge(w)
+		return
+	}
+	app.errorWrongFormat(w, bodyViolation(err))
+}
+
+func bodyViolation(err error) validator.Violation {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return validator.Violation{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Value:   typeErr.Value,
+			Message: fmt.Sprintf("%s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value),
+		}
+	}
+	return validator.Violation{
+		Field:   "body",
+		Rule:    "json",
+		Message: "body must be valid JSON: " + err.Error(),
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+	"github.com/h3ll0kitt1/avitotest/internal/validator"
 )
 
 // GetHistory godoc
@@ -20,7 +29,11 @@ import (
 //	@param          body    body    historyDownloadForm    true    "History form"
 //	@success        200 string    string
 //	@failure        400 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
 //	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
 //	@router         /history [get]
 func (app *application) getHistory(w http.ResponseWriter, r *http.Request) {
 
@@ -30,30 +43,41 @@ func (app *application) getHistory(w http.ResponseWriter, r *http.Request) {
 		app.logger.Errorw("error",
 			"getHistory: error parsing historyDownloadForm", err,
 		)
-		app.errorWrongFormat(w)
+		app.errorRequestBody(w, err)
 		return
 	}
 
-	for _, user := range form.Users {
-		ok := app.validator.UserId(user)
-		if !ok {
-			app.errorWrongFormat(w)
-			return
-		}
+	if app.listTooLong(len(form.Users)) || app.listTooLong(len(form.Segments)) {
+		app.errorTooLarge(w)
+		return
 	}
 
-	ok := app.validator.Days(form.Days)
-	if !ok {
-		app.errorWrongFormat(w)
+	var violations validator.Violations
+	for i, user := range form.Users {
+		violations = append(violations, app.validator.UserId(fmt.Sprintf("user_list[%d]", i), user)...)
+	}
+	for i, slug := range form.Segments {
+		violations = append(violations, app.validator.SegmentSlug(fmt.Sprintf("segment_list[%d]", i), slug)...)
+	}
+	violations = append(violations, app.validator.Days("days", form.Days)...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	history, err := app.storage.GetHistory(r.Context(), form.Users, form.Days)
+	filter := models.HistoryFilter{
+		Users:          form.Users,
+		Segments:       form.Segments,
+		Days:           form.Days,
+		IncludeArchive: form.IncludeArchive,
+	}
+
+	history, err := app.storage.GetHistory(r.Context(), filter)
 	if err != nil {
 		app.logger.Errorw("error",
 			"getHistory: error retrieving data from storage", err,
 		)
-		app.errorInternalServer(w)
+		app.errorStorage(w, err)
 		return
 	}
 
@@ -86,31 +110,35 @@ func (app *application) getHistory(w http.ResponseWriter, r *http.Request) {
 }
 
 type historyDownloadForm struct {
-	Users []int64 `json:"user_list"`
-	Days  int     `json:"days"`
+	Users          []int64  `json:"user_list"`
+	Segments       []string `json:"segment_list,omitempty"`
+	Days           int      `json:"days"`
+	IncludeArchive bool     `json:"include_archive,omitempty"`
 }
 
 // CreateSegment godoc
 //
 //	@summary        Создать сегмент
-//	@description    В зависимости от параметров либо просто создает сегмент, либо создает сегмент и добавляет в него переданный процент случайно выбранных пользователей
+//	@description    В зависимости от параметров либо просто создает сегмент с описанием, владельцем, тегами и атрибутами, либо создает сегмент и добавляет в него переданный процент случайно выбранных пользователей
 //	@tags           segments
 //	@accept         json
 //	@produce        json
 //	@param          slug  path    string  true    "Segment name"
+//	@param          Idempotency-Key  header  string  false  "Idempotency key"
 //	@param          body  body    createSegmentForm  true    "Segment form"
-//	@success        200 string string
+//	@success        200 {object}    models.CreateSegmentResult
 //	@failure        400 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        422 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
 //	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
 //	@router         /segments/{slug} [post]
 func (app *application) createSegment(w http.ResponseWriter, r *http.Request) {
 
 	slug := chi.URLParam(r, "slug")
-	ok := app.validator.SegmentSlug(slug)
-	if !ok {
-		app.errorWrongFormat(w)
-		return
-	}
+	violations := app.validator.SegmentSlug("slug", slug)
 
 	var form createSegmentForm
 	err := json.NewDecoder(r.Body).Decode(&form)
@@ -118,57 +146,245 @@ func (app *application) createSegment(w http.ResponseWriter, r *http.Request) {
 		app.logger.Errorw("error",
 			"createSegment: error parsing createSegmentForm", err,
 		)
-		app.errorWrongFormat(w)
+		app.errorRequestBody(w, err)
 		return
 	}
 
-	ok = app.validator.PercentageRND(form.PercentageRND)
-	if !ok {
-		app.errorWrongFormat(w)
+	segment := models.SegmentInfo{
+		Slug:         slug,
+		Description:  form.Description,
+		Owner:        form.Owner,
+		Tags:         form.Tags,
+		Attributes:   form.Attributes,
+		Rule:         form.Rule,
+		Materialized: form.Materialized,
+		Composition:  form.Composition,
+	}
+
+	violations = append(violations, app.validator.PercentageRND("percentage_random", form.PercentageRND)...)
+	violations = append(violations, app.validator.PercentageComposition("percentage_random", form.PercentageRND, form.Composition)...)
+	violations = append(violations, app.validator.SegmentInfo(segment)...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	if err := app.storage.CreateSegment(r.Context(), slug, form.PercentageRND); err != nil {
+	result, err := app.storage.CreateSegment(r.Context(), segment, form.PercentageRND)
+	if err != nil {
 		app.logger.Errorw("error",
 			"createSegment: error inserting data to storage", err,
 		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"createSegment: error converting result to json", err,
+		)
 		app.errorInternalServer(w)
 		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{}"))
+	w.Write(jsonData)
 }
 
 type createSegmentForm struct {
-	PercentageRND int `json:"percentage_random"`
+	PercentageRND int                 `json:"percentage_random"`
+	Description   string              `json:"description,omitempty"`
+	Owner         string              `json:"owner,omitempty"`
+	Tags          []string            `json:"tags,omitempty"`
+	Attributes    json.RawMessage     `json:"attributes,omitempty" swaggertype:"object"`
+	Rule          string              `json:"rule,omitempty"`
+	Materialized  bool                `json:"materialized,omitempty"`
+	Composition   *models.Composition `json:"composition,omitempty"`
+}
+
+// UpdateSegment godoc
+//
+//	@summary        Изменить описание сегмента
+//	@description    Изменяет только переданные поля описания сегмента: описание, владельца, теги, атрибуты, правило, режим материализации и состав, пустое правило и состав без операции делают сегмент обычным
+//	@tags           segments
+//	@accept         json
+//	@produce        json
+//	@param          slug  path    string  true    "Segment name"
+//	@param          body  body    models.SegmentPatch  true    "Segment fields to change"
+//	@success        200 {object}    models.SegmentInfo
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        422 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug} [patch]
+func (app *application) updateSegment(w http.ResponseWriter, r *http.Request) {
+
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
+
+	var patch models.SegmentPatch
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegment: error parsing SegmentPatch", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	violations = append(violations, app.validator.SegmentPatch(patch)...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	segment, err := app.storage.UpdateSegment(r.Context(), slug, patch)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegment: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(segment)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegment: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// GetSegment godoc
+//
+//	@summary        Получить сегмент
+//	@description    Возвращает сегмент с описанием, владельцем, тегами, атрибутами и временем создания и изменения
+//	@tags           segments
+//	@produce        json
+//	@param          slug  path    string  true    "Segment name"
+//	@success        200 {object}    models.SegmentInfo
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug} [get]
+func (app *application) getSegment(w http.ResponseWriter, r *http.Request) {
+
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	segment, err := app.storage.GetSegment(r.Context(), slug)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getSegment: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(segment)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getSegment: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// ListSegments godoc
+//
+//	@summary        Получить список сегментов
+//	@description    Возвращает все сегменты с описанием, если передан тег, то только сегменты с этим тегом
+//	@tags           segments
+//	@produce        json
+//	@param          tag  query    string  false    "Segment tag"
+//	@success        200 {array}     models.SegmentInfo
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments [get]
+func (app *application) listSegments(w http.ResponseWriter, r *http.Request) {
+
+	segments, err := app.storage.GetSegments(r.Context(), r.URL.Query().Get("tag"))
+	if err != nil {
+		app.logger.Errorw("error",
+			"listSegments: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(segments)
+	if err != nil {
+		app.logger.Errorw("error",
+			"listSegments: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
 }
 
 // DeleteSegment godoc
 //
 //	@summary        Удалить сегмент
-//	@description    Удаляет сегмент
+//	@description    Переносит сегмент вместе с пользователями в архив, по истечении срока хранения архива сегмент удаляется окончательно. Если сегмента не существует или он уже в архиве, то возвращает 404
 //	@tags           segments
 //	@produce        json
 //	@param          slug  path    string  true    "Segment Name"
+//	@param          lenient  query   bool  false  "Do not fail if segment does not exist"
 //	@success        200
 //	@failure        400  {object}  errorResponse
+//	@failure        404  {object}  errorResponse
+//	@failure        409  {object}  errorResponse
+//	@failure        429  {object}  errorResponse
 //	@failure        500  {object}  errorResponse
 //	@router         /segments/{slug} [delete]
 func (app *application) deleteSegment(w http.ResponseWriter, r *http.Request) {
 
 	slug := chi.URLParam(r, "slug")
-	ok := app.validator.SegmentSlug(slug)
-	if !ok {
-		app.errorWrongFormat(w)
+	violations := app.validator.SegmentSlug("slug", slug)
+
+	lenient, lenientViolations := parseLenient(r)
+	violations = append(violations, lenientViolations...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	if err := app.storage.DeleteSegment(r.Context(), slug); err != nil {
+	err := app.storage.DeleteSegment(r.Context(), slug)
+	if lenient && errors.Is(err, storage.ErrSegmentNotFound) {
+		err = nil
+	}
+	if err != nil {
 		app.logger.Errorw("error",
 			"deleteSegment: error deleting data from storage", err,
 		)
-		app.errorInternalServer(w)
+		app.errorStorage(w, err)
 		return
 	}
 
@@ -177,47 +393,74 @@ func (app *application) deleteSegment(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{}"))
 }
 
-// GetSegments godoc
+// RenameSegment godoc
 //
-//	@summary        Получить сегменты пользователя
-//	@description    Возвращает список сегментов, в которых состоит пользователь, если таких нет, то возвращает пустой список
-//	@tags           users-segments
-//	@param          user_id      path    int  true    "User ID"
+//	@summary        Переименовать сегмент
+//	@description    Переносит сегмент вместе с пользователями и описанием на новое название и записывает переименование в историю, старое название остается псевдонимом для выгрузки истории
+//	@tags           segments
 //	@accept         json
 //	@produce        json
-//	@success        200 string string
+//	@param          slug  path    string  true    "Segment name"
+//	@param          body  body    renameSegmentForm  true    "Rename form"
+//	@success        200 {object}    models.SegmentInfo
 //	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
 //	@failure        500 {object}    errorResponse
-//	@router         /users-segments/{user_id} [get]
-func (app *application) getSegments(w http.ResponseWriter, r *http.Request) {
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug}/rename [post]
+func (app *application) renameSegment(w http.ResponseWriter, r *http.Request) {
 
-	userStr := chi.URLParam(r, "user_id")
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
 
-	user, err := strconv.ParseInt(userStr, 10, 64)
+	var form renameSegmentForm
+	err := json.NewDecoder(r.Body).Decode(&form)
 	if err != nil {
-		app.errorWrongFormat(w)
+		app.logger.Errorw("error",
+			"renameSegment: error parsing renameSegmentForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	violations = append(violations, app.validator.SegmentSlug("new_slug", form.NewSlug)...)
+	if form.NewSlug == "" || form.NewSlug == slug {
+		violations = append(violations, validator.Violation{
+			Field:   "new_slug",
+			Rule:    "changed",
+			Value:   form.NewSlug,
+			Message: "new_slug must be non-empty and differ from the current name",
+		})
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	ok := app.validator.UserId(user)
-	if !ok {
-		app.errorWrongFormat(w)
+	if err := app.storage.RenameSegment(r.Context(), slug, form.NewSlug); err != nil {
+		app.logger.Errorw("error",
+			"renameSegment: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
 		return
 	}
 
-	segments, err := app.storage.GetSegmentsByUserID(r.Context(), user)
+	segment, err := app.storage.GetSegment(r.Context(), form.NewSlug)
 	if err != nil {
 		app.logger.Errorw("error",
-			"getSegments: error retrieving data from storage", err,
+			"renameSegment: error retrieving data from storage", err,
 		)
-		app.errorInternalServer(w)
+		app.errorStorage(w, err)
 		return
 	}
 
-	jsonData, err := json.Marshal(segments)
+	jsonData, err := json.Marshal(segment)
 	if err != nil {
 		app.logger.Errorw("error",
-			"getSegments: error converting data to json", err,
+			"renameSegment: error converting data to json", err,
 		)
 		app.errorInternalServer(w)
 		return
@@ -225,62 +468,105 @@ func (app *application) getSegments(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(jsonData))
+	w.Write(jsonData)
 }
 
-// UpdateSegments godoc
+type renameSegmentForm struct {
+	NewSlug string `json:"new_slug"`
+}
+
+// RestoreSegment godoc
 //
-//	@summary        Обновить сегменты пользователя
-//	@description    Для пользователя удаляет сегменты из переданного списка, затем добавляет из второго переданного списка сегменты с указанным в днях TTL
-//	@tags           users-segments
-//	@accept         json
+//	@summary        Восстановить сегмент из архива
+//	@description    Возвращает архивный сегмент вместе с пользователями и записывает восстановление в историю. Если сегмент не в архиве, то ничего не меняет
+//	@tags           segments
 //	@produce        json
-//	@param          user_id      path    int  true    "User ID"
-//	@param          body    body    updateSegmentsForm    true    "Segments form"
-//	@success        200 string string
+//	@param          slug  path    string  true    "Segment name"
+//	@success        200 {object}    models.SegmentInfo
 //	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
 //	@failure        500 {object}    errorResponse
-//	@router         /users-segments/{user_id} [put]
-func (app *application) updateSegments(w http.ResponseWriter, r *http.Request) {
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug}/restore [post]
+func (app *application) restoreSegment(w http.ResponseWriter, r *http.Request) {
 
-	userStr := chi.URLParam(r, "user_id")
-	user, err := strconv.ParseInt(userStr, 10, 64)
-	if err != nil {
-		app.errorWrongFormat(w)
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	ok := app.validator.UserId(user)
-	if !ok {
-		app.errorWrongFormat(w)
+	if err := app.storage.RestoreSegment(r.Context(), slug); err != nil {
+		app.logger.Errorw("error",
+			"restoreSegment: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
 		return
 	}
 
-	var form updateSegmentsForm
-	err = json.NewDecoder(r.Body).Decode(&form)
+	segment, err := app.storage.GetSegment(r.Context(), slug)
 	if err != nil {
 		app.logger.Errorw("error",
-			"updateSegments: error parsing updateSegmentsForm", err,
+			"restoreSegment: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(segment)
+	if err != nil {
+		app.logger.Errorw("error",
+			"restoreSegment: error converting data to json", err,
 		)
-		app.errorWrongFormat(w)
+		app.errorInternalServer(w)
 		return
 	}
 
-	ok = app.validator.Segments(form.Delete)
-	if !ok {
-		app.errorWrongFormat(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// RecomputeSegment godoc
+//
+//	@summary        Пересчитать материализованный сегмент
+//	@description    Сразу пересчитывает членство всех пользователей в материализованном сегменте с правилом: добавляет подходящих под правило и удаляет добавленных по правилу неподходящих. Для сегмента без правила или не материализованного удаляет всех добавленных по правилу пользователей
+//	@tags           segments
+//	@produce        json
+//	@param          slug  path    string  true    "Segment name"
+//	@success        200 {object}    models.RecomputeResult
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug}/recompute [post]
+func (app *application) recomputeSegment(w http.ResponseWriter, r *http.Request) {
+
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
 		return
 	}
 
-	ok = app.validator.Segments(form.Add)
-	if !ok {
-		app.errorWrongFormat(w)
+	result, err := app.storage.RecomputeSegment(r.Context(), slug)
+	if err != nil {
+		app.logger.Errorw("error",
+			"recomputeSegment: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
 		return
 	}
 
-	if err := app.storage.UpdateSegmentsByUserID(r.Context(), user, form.Delete, form.Add); err != nil {
+	jsonData, err := json.Marshal(result)
+	if err != nil {
 		app.logger.Errorw("error",
-			"updateSegments: error updating data in storage", err,
+			"recomputeSegment: error converting data to json", err,
 		)
 		app.errorInternalServer(w)
 		return
@@ -288,72 +574,1134 @@ func (app *application) updateSegments(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{}"))
+	w.Write(jsonData)
 }
 
-type updateSegmentsForm struct {
-	Delete []models.Segment `json:"list_delete,omitempty"`
-	Add    []models.Segment `json:"list_add,omitempty"`
-}
+// ImportSegmentUsers godoc
+//
+//	@summary        Импортировать пользователей сегмента из файла
+//	@description    Принимает CSV файл или список идентификаторов пользователей по одному в строке, вторая колонка CSV - необязательный TTL в днях. Файл проверяется сразу, а пользователи добавляются в сегмент или удаляются из него в фоновой задаче, прогресс которой можно узнать по ссылке из заголовка Location
+//	@tags           segments
+//	@accept         plain
+//	@accept         text/csv
+//	@accept         mpfd
+//	@produce        json
+//	@param          slug  path    string  true    "Segment name"
+//	@param          mode  query   string  false   "Import mode" Enums(add, remove)
+//	@param          body  body    string  true    "CSV or newline-separated user IDs"
+//	@success        202 {object}    models.ImportJob
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        422 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug}/users/import [post]
+func (app *application) importSegmentUsers(w http.ResponseWriter, r *http.Request) {
 
-type errorResponse struct {
-	Error Error `json:"error"`
-}
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
 
-type Error struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-}
+	mode := models.ImportMode(r.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = models.ImportAdd
+	}
+	if mode != models.ImportAdd && mode != models.ImportRemove {
+		violations = append(violations, validator.Violation{
+			Field:   "mode",
+			Rule:    "enum",
+			Value:   mode,
+			Message: "mode must be add or remove",
+		})
+	}
+
+	data, err := readImportFile(r)
+	if err != nil {
+		app.logger.Errorw("error",
+			"importSegmentUsers: error reading import file", err,
+		)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.errorTooLarge(w)
+			return
+		}
+		app.errorWrongFormat(w, validator.Violation{
+			Field:   "body",
+			Rule:    "file",
+			Message: "body must be a CSV file or multipart form with file field: " + err.Error(),
+		})
+		return
+	}
+
+	rows, rowViolations := parseImportRows(data, mode)
+	violations = append(violations, rowViolations...)
+	violations = append(violations, app.validator.ImportRows("rows", rows)...)
 
-func (app *application) errorNotFound(w http.ResponseWriter, r *http.Request) {
-	var error errorResponse
-	error.Error.Code = http.StatusNotFound
-	error.Error.Message = "Wrong resource url"
+	// Для больших файлов с ошибками возвращаем только первые нарушения, чтобы не раздувать ответ
+	if len(violations) > maxImportViolations {
+		violations = violations[:maxImportViolations]
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
 
-	jsonErr, err := json.Marshal(error)
+	job, err := app.storage.CreateImportJob(r.Context(), slug, mode, len(rows))
 	if err != nil {
 		app.logger.Errorw("error",
-			"errorNotFound: error converting data to json", err,
+			"importSegmentUsers: error creating import job in storage", err,
 		)
+		app.errorStorage(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	w.Write(jsonErr)
-}
 
-func (app *application) errorInternalServer(w http.ResponseWriter) {
-	var error errorResponse
-	error.Error.Code = http.StatusInternalServerError
-	error.Error.Message = "Error while processing request. Please, contact support"
+	// Задача выполняется после ответа клиенту, поэтому не привязана к контексту запроса
+	go app.storage.RunImportJob(job, rows)
 
-	jsonErr, err := json.Marshal(error)
+	jsonData, err := json.Marshal(job)
 	if err != nil {
 		app.logger.Errorw("error",
-			"errorNotFound: error converting data to json", err,
+			"importSegmentUsers: error converting data to json", err,
 		)
+		app.errorInternalServer(w)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write(jsonErr)
+	w.Header().Set("Location", fmt.Sprintf("/segments/%s/users/import/%d", slug, job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonData)
 }
 
-func (app *application) errorWrongFormat(w http.ResponseWriter) {
-	var error errorResponse
-	error.Error.Code = http.StatusBadRequest
-	error.Error.Message = "Wrong body request or url params format"
+// GetImportJob godoc
+//
+//	@summary        Получить состояние импорта
+//	@description    Возвращает состояние задачи импорта пользователей сегмента и число уже обработанных строк файла
+//	@tags           segments
+//	@produce        json
+//	@param          slug    path    string  true    "Segment name"
+//	@param          job_id  path    int     true    "Import job ID"
+//	@success        200 {object}    models.ImportJob
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /segments/{slug}/users/import/{job_id} [get]
+func (app *application) getImportJob(w http.ResponseWriter, r *http.Request) {
+
+	slug := chi.URLParam(r, "slug")
+	violations := app.validator.SegmentSlug("slug", slug)
+
+	jobStr := chi.URLParam(r, "job_id")
+	id, err := strconv.ParseInt(jobStr, 10, 64)
+	if err != nil {
+		violations = append(violations, validator.Violation{
+			Field:   "job_id",
+			Rule:    "type",
+			Value:   jobStr,
+			Message: "job_id must be an integer",
+		})
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	job, err := app.storage.GetImportJob(r.Context(), slug, id)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getImportJob: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
 
-	jsonErr, err := json.Marshal(error)
+	jsonData, err := json.Marshal(job)
 	if err != nil {
 		app.logger.Errorw("error",
-			"errorNotFound: error converting data to json", err,
+			"getImportJob: error converting data to json", err,
 		)
+		app.errorInternalServer(w)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write(jsonErr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+const maxImportViolations = 100
+
+// Файл можно передать телом запроса или полем file формы multipart/form-data
+func readImportFile(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return io.ReadAll(r.Body)
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("form has no file field")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// Файл импорта - CSV с колонкой user_id и необязательной колонкой days_ttl, разделенными запятой или точкой с запятой,
+// либо просто список идентификаторов по одному в строке. Первая строка может быть заголовком.
+// В режиме удаления колонка days_ttl не учитывается
+func parseImportRows(data []byte, mode models.ImportMode) ([]models.ImportRow, validator.Violations) {
+
+	// Excel добавляет в начало файла BOM
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Contains(firstLine, []byte(";")) && !bytes.Contains(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	rows := make([]models.ImportRow, 0)
+	var violations validator.Violations
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			violations = append(violations, validator.Violation{
+				Field:   "body",
+				Rule:    "csv",
+				Message: "body must be a valid CSV file: " + err.Error(),
+			})
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		prefix := fmt.Sprintf("rows[%d]", line)
+
+		userStr := strings.TrimSpace(record[0])
+		user, err := strconv.ParseInt(userStr, 10, 64)
+		if err != nil && first {
+			continue
+		}
+		if err != nil {
+			violations = append(violations, validator.Violation{
+				Field:   prefix + ".user_id",
+				Rule:    "type",
+				Value:   userStr,
+				Message: prefix + ".user_id must be an integer",
+			})
+			continue
+		}
+
+		if len(record) > 2 {
+			violations = append(violations, validator.Violation{
+				Field:   prefix,
+				Rule:    "columns",
+				Value:   len(record),
+				Message: prefix + " must contain user_id and optional days_ttl only",
+			})
+			continue
+		}
+
+		row := models.ImportRow{Line: line, User: user}
+		if len(record) == 2 && mode == models.ImportAdd {
+			ttlStr := strings.TrimSpace(record[1])
+			if ttlStr != "" {
+				row.DaysTTL, err = strconv.Atoi(ttlStr)
+				if err != nil {
+					violations = append(violations, validator.Violation{
+						Field:   prefix + ".days_ttl",
+						Rule:    "type",
+						Value:   ttlStr,
+						Message: prefix + ".days_ttl must be an integer",
+					})
+					continue
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 && len(violations) == 0 {
+		violations = append(violations, validator.Violation{
+			Field:   "body",
+			Rule:    "required",
+			Message: "file must contain at least one user_id",
+		})
+	}
+	return rows, violations
+}
+
+// CreateUser godoc
+//
+//	@summary        Зарегистрировать пользователя
+//	@description    Регистрирует пользователя с атрибутами, если его еще нет, и возвращает его вместе с признаком created, атрибуты уже зарегистрированного пользователя не меняются. Зарегистрированные пользователи участвуют в выборке случайного процента пользователей при создании сегмента
+//	@tags           users
+//	@accept         json
+//	@produce        json
+//	@param          body    body    createUserForm    true    "User form"
+//	@success        200 {object}    models.CreateUserResult
+//	@failure        400 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users [post]
+func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
+
+	var form createUserForm
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		app.logger.Errorw("error",
+			"createUser: error parsing createUserForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	violations := app.validator.UserId("user_id", form.User)
+	if len(form.Attributes) != 0 {
+		violations = append(violations, app.validator.UserAttributes("attributes", form.Attributes)...)
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	result, err := app.storage.CreateUser(r.Context(), form.User, form.Attributes)
+	if err != nil {
+		app.logger.Errorw("error",
+			"createUser: error inserting data to storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"createUser: error converting result to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+type createUserForm struct {
+	User       int64           `json:"user_id"`
+	Attributes json.RawMessage `json:"attributes,omitempty" swaggertype:"object"`
+}
+
+// ImportUsers godoc
+//
+//	@summary        Зарегистрировать многих пользователей
+//	@description    Регистрирует всех еще не зарегистрированных пользователей из списка одним запросом и возвращает число новых и уже существовавших пользователей
+//	@tags           users
+//	@accept         json
+//	@produce        json
+//	@param          body    body    importUsersForm    true    "Import form"
+//	@success        200 {object}    models.UserImportResult
+//	@failure        400 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users:import [post]
+func (app *application) importUsers(w http.ResponseWriter, r *http.Request) {
+
+	var form importUsersForm
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		app.logger.Errorw("error",
+			"importUsers: error parsing importUsersForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	if app.listTooLong(len(form.Users)) {
+		app.errorTooLarge(w)
+		return
+	}
+
+	var violations validator.Violations
+	for i, user := range form.Users {
+		violations = append(violations, app.validator.UserId(fmt.Sprintf("user_ids[%d]", i), user)...)
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	result, err := app.storage.ImportUsers(r.Context(), form.Users)
+	if err != nil {
+		app.logger.Errorw("error",
+			"importUsers: error inserting data to storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"importUsers: error converting result to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+type importUsersForm struct {
+	Users []int64 `json:"user_ids"`
+}
+
+// GetUser godoc
+//
+//	@summary        Получить пользователя
+//	@description    Возвращает зарегистрированного пользователя и время регистрации, если пользователь неизвестен, то возвращает 404
+//	@tags           users
+//	@produce        json
+//	@param          user_id      path    int  true    "User ID"
+//	@success        200 {object}    models.User
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users/{user_id} [get]
+func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	result, err := app.storage.GetUser(r.Context(), user)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getUser: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getUser: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// ListUsers godoc
+//
+//	@summary        Получить список пользователей
+//	@description    Возвращает страницу зарегистрированных пользователей по возрастанию идентификатора. Следующая страница запрашивается с параметром after, равным next_after из ответа, на последней странице next_after не возвращается
+//	@tags           users
+//	@produce        json
+//	@param          after   query   int  false  "Return users with ID greater than this"
+//	@param          limit   query   int  false  "Page size, 100 by default"
+//	@success        200 {object}    listUsersResult
+//	@failure        400 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users [get]
+func (app *application) listUsers(w http.ResponseWriter, r *http.Request) {
+
+	after, violations := parseIntQuery(r, "after", 0)
+	limit, limitViolations := parseIntQuery(r, "limit", defaultPageSize)
+	violations = append(violations, limitViolations...)
+	if len(violations) == 0 {
+		violations = app.validator.Page(after, int(limit))
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	// Запрашиваем на одного пользователя больше, чтобы узнать, есть ли следующая страница
+	users, err := app.storage.GetUsers(r.Context(), after, int(limit)+1)
+	if err != nil {
+		app.logger.Errorw("error",
+			"listUsers: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	result := listUsersResult{Users: users}
+	if len(users) > int(limit) {
+		result.Users = users[:limit]
+		result.NextAfter = &result.Users[limit-1].ID
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"listUsers: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// Размер страницы списка пользователей, если параметр limit не передан
+const defaultPageSize = 100
+
+// listUsersResult - страница пользователей и идентификатор, с которого начинается следующая страница
+type listUsersResult struct {
+	Users     []models.User `json:"users"`
+	NextAfter *int64        `json:"next_after,omitempty"`
+}
+
+// UpdateUserAttributes godoc
+//
+//	@summary        Изменить атрибуты пользователя
+//	@description    PUT заменяет все атрибуты пользователя переданным JSON объектом, PATCH дописывает переданные атрибуты к текущим, атрибуты со значением null удаляются. Неизвестный пользователь регистрируется. Атрибуты используются в правилах сегментов
+//	@tags           users
+//	@accept         json
+//	@produce        json
+//	@param          user_id      path    int     true    "User ID"
+//	@param          body         body    object  true    "User attributes"
+//	@success        200 {object}    models.User
+//	@failure        400 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users/{user_id}/attributes [put]
+//	@router         /users/{user_id}/attributes [patch]
+func (app *application) updateUserAttributes(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+
+	var attributes json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&attributes)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateUserAttributes: error parsing attributes", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	violations = append(violations, app.validator.UserAttributes("body", attributes)...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	merge := r.Method == http.MethodPatch
+	result, err := app.storage.UpdateUserAttributes(r.Context(), user, attributes, merge)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateUserAttributes: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateUserAttributes: error converting result to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// DeleteUser godoc
+//
+//	@summary        Удалить пользователя
+//	@description    Удаляет пользователя из всех сегментов и, в зависимости от настройки сервиса, обезличивает или удаляет его историю, удаление записывается в журнал аудита. Если о пользователе нет ни членства, ни истории, то возвращает 404
+//	@tags           users
+//	@produce        json
+//	@param          user_id      path    int  true    "User ID"
+//	@success        200 {object}    models.UserErasure
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users/{user_id} [delete]
+func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	erasure, err := app.storage.DeleteUser(r.Context(), user, app.erasure)
+	if err != nil {
+		app.logger.Errorw("error",
+			"deleteUser: error deleting data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(erasure)
+	if err != nil {
+		app.logger.Errorw("error",
+			"deleteUser: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// GetSegments godoc
+//
+//	@summary        Получить сегменты пользователя
+//	@description    Возвращает список сегментов, в которых состоит пользователь, если таких нет, то возвращает пустой список, если пользователь неизвестен, то возвращает 404
+//	@tags           users-segments
+//	@param          user_id      path    int  true    "User ID"
+//	@param          lenient      query   bool false   "Return empty list for unknown user"
+//	@accept         json
+//	@produce        json
+//	@success        200 string string
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users-segments/{user_id} [get]
+func (app *application) getSegments(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+
+	lenient, lenientViolations := parseLenient(r)
+	violations = append(violations, lenientViolations...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	segments, err := app.storage.GetSegmentsByUserID(r.Context(), user)
+	if lenient && errors.Is(err, storage.ErrUserNotFound) {
+		segments, err = make([]models.Segment, 0), nil
+	}
+	if err != nil {
+		app.logger.Errorw("error",
+			"getSegments: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(segments)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getSegments: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(jsonData))
+}
+
+// GetMembership godoc
+//
+//	@summary        Проверить, состоит ли пользователь в сегменте
+//	@description    Возвращает, состоит ли пользователь в активном сегменте, время окончания TTL и время добавления пользователя в сегмент. Если сегмент или пользователь неизвестен, то возвращает 404
+//	@tags           users-segments
+//	@produce        json
+//	@param          user_id      path    int     true    "User ID"
+//	@param          slug         path    string  true    "Segment name"
+//	@param          lenient      query   bool    false   "Return member=false for unknown user or segment"
+//	@success        200 {object}    models.Membership
+//	@failure        400 {object}    errorResponse
+//	@failure        404 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users-segments/{user_id}/{slug} [get]
+func (app *application) getMembership(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+
+	slug := chi.URLParam(r, "slug")
+	violations = append(violations, app.validator.SegmentSlug("slug", slug)...)
+
+	lenient, lenientViolations := parseLenient(r)
+	violations = append(violations, lenientViolations...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	membership, err := app.storage.GetMembership(r.Context(), user, slug)
+	if lenient && (errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, storage.ErrSegmentNotFound)) {
+		membership, err = models.Membership{User: user, Slug: slug}, nil
+	}
+	if err != nil {
+		app.logger.Errorw("error",
+			"getMembership: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(membership)
+	if err != nil {
+		app.logger.Errorw("error",
+			"getMembership: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// LookupSegments godoc
+//
+//	@summary        Получить сегменты многих пользователей
+//	@description    Возвращает активные сегменты для каждого из переданных пользователей одним запросом к базе данных. Пользователи без сегментов и неизвестные пользователи получают пустой список
+//	@tags           users-segments
+//	@accept         json
+//	@produce        json
+//	@param          body    body    lookupSegmentsForm    true    "Lookup form"
+//	@success        200 {object}    lookupSegmentsResult
+//	@failure        400 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users-segments:lookup [post]
+func (app *application) lookupSegments(w http.ResponseWriter, r *http.Request) {
+
+	var form lookupSegmentsForm
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		app.logger.Errorw("error",
+			"lookupSegments: error parsing lookupSegmentsForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	if app.listTooLong(len(form.Users)) {
+		app.errorTooLarge(w)
+		return
+	}
+
+	var violations validator.Violations
+	for i, user := range form.Users {
+		violations = append(violations, app.validator.UserId(fmt.Sprintf("user_ids[%d]", i), user)...)
+	}
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	segments, err := app.storage.GetSegmentsByUserIDs(r.Context(), form.Users)
+	if err != nil {
+		app.logger.Errorw("error",
+			"lookupSegments: error retrieving data from storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(lookupSegmentsResult{Users: segments})
+	if err != nil {
+		app.logger.Errorw("error",
+			"lookupSegments: error converting data to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+type lookupSegmentsForm struct {
+	Users []int64 `json:"user_ids"`
+}
+
+// lookupSegmentsResult - активные сегменты по идентификатору пользователя
+type lookupSegmentsResult struct {
+	Users map[int64][]models.Segment `json:"users"`
+}
+
+// UpdateSegments godoc
+//
+//	@summary        Обновить сегменты пользователя
+//	@description    Для пользователя удаляет сегменты из переданного списка, затем добавляет из второго переданного списка сегменты с указанным в днях TTL и возвращает произошедшие изменения и итоговый список сегментов пользователя
+//	@tags           users-segments
+//	@accept         json
+//	@produce        json
+//	@param          user_id      path    int  true    "User ID"
+//	@param          strict  query   bool false    "Reject adding to segments that do not exist"
+//	@param          Idempotency-Key  header  string  false  "Idempotency key"
+//	@param          body    body    updateSegmentsForm    true    "Segments form"
+//	@success        200 {object}    models.UpdateResult
+//	@failure        400 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        422 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users-segments/{user_id} [put]
+func (app *application) updateSegments(w http.ResponseWriter, r *http.Request) {
+
+	user, violations := app.parseUserID(chi.URLParam(r, "user_id"))
+
+	var form updateSegmentsForm
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegments: error parsing updateSegmentsForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	if app.listTooLong(len(form.Delete)) || app.listTooLong(len(form.Add)) {
+		app.errorTooLarge(w)
+		return
+	}
+
+	violations = append(violations, app.validator.Segments("list_delete", form.Delete)...)
+	violations = append(violations, app.validator.Segments("list_add", form.Add)...)
+
+	// Строгий режим можно включить или выключить для конкретного запроса, иначе используется настройка сервера
+	strict, strictViolations := parseBoolQuery(r, "strict", app.strict)
+	violations = append(violations, strictViolations...)
+
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	result, err := app.storage.UpdateSegmentsByUserID(r.Context(), user, form.Delete, form.Add, strict)
+	var unknownErr *storage.UnknownSegmentsError
+	if errors.As(err, &unknownErr) {
+		app.errorUnprocessable(w, StatusUnknownSegments, "Segments do not exist: "+strings.Join(unknownErr.Slugs, ", "),
+			unknownSegmentsViolations("list_add", form.Add, unknownErr.Slugs)...)
+		return
+	}
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegments: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegments: error converting result to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+type updateSegmentsForm struct {
+	Delete []models.Segment `json:"list_delete,omitempty"`
+	Add    []models.Segment `json:"list_add,omitempty"`
+}
+
+// UpdateSegmentsBatch godoc
+//
+//	@summary        Обновить сегменты многих пользователей
+//	@description    Применяет изменения сегментов для списка пользователей в одной транзакции. По умолчанию пакет применяется целиком или не применяется совсем. С параметром partial=true операции с ошибками не применяются и возвращаются с описанием ошибки, остальные операции применяются
+//	@tags           users-segments
+//	@accept         json
+//	@produce        json
+//	@param          strict  query   bool false    "Reject adding to segments that do not exist"
+//	@param          partial  query   bool false    "Apply valid operations and report failed ones"
+//	@param          Idempotency-Key  header  string  false  "Idempotency key"
+//	@param          body    body    updateSegmentsBatchForm    true    "Batch form"
+//	@success        200 {object}    batchResult
+//	@failure        400 {object}    errorResponse
+//	@failure        409 {object}    errorResponse
+//	@failure        413 {object}    errorResponse
+//	@failure        422 {object}    errorResponse
+//	@failure        429 {object}    errorResponse
+//	@failure        500 {object}    errorResponse
+//	@failure        503 {object}    errorResponse
+//	@router         /users-segments:batch [post]
+func (app *application) updateSegmentsBatch(w http.ResponseWriter, r *http.Request) {
+
+	var form updateSegmentsBatchForm
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegmentsBatch: error parsing updateSegmentsBatchForm", err,
+		)
+		app.errorRequestBody(w, err)
+		return
+	}
+
+	if app.listTooLong(len(form.Operations)) {
+		app.errorTooLarge(w)
+		return
+	}
+	for _, operation := range form.Operations {
+		if app.listTooLong(len(operation.Delete)) || app.listTooLong(len(operation.Add)) {
+			app.errorTooLarge(w)
+			return
+		}
+	}
+
+	strict, violations := parseBoolQuery(r, "strict", app.strict)
+	partial, partialViolations := parseBoolQuery(r, "partial", false)
+	violations = append(violations, partialViolations...)
+	if len(violations) != 0 {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	// Каждую операцию проверяем отдельно, чтобы в режиме partial отклонить только операции с ошибками
+	results := make([]batchItemResult, len(form.Operations))
+	operations := make([]models.BatchOperation, 0, len(form.Operations))
+	positions := make([]int, 0, len(form.Operations))
+	seen := make(map[int64]bool, len(form.Operations))
+
+	for i, operation := range form.Operations {
+		prefix := fmt.Sprintf("operations[%d]", i)
+
+		itemViolations := app.validator.UserId(prefix+".user_id", operation.User)
+		if seen[operation.User] {
+			itemViolations = append(itemViolations, validator.Violation{
+				Field:   prefix + ".user_id",
+				Rule:    "unique",
+				Value:   operation.User,
+				Message: prefix + ".user_id must not repeat in one batch",
+			})
+		}
+		seen[operation.User] = true
+		itemViolations = append(itemViolations, app.validator.Segments(prefix+".list_delete", operation.Delete)...)
+		itemViolations = append(itemViolations, app.validator.Segments(prefix+".list_add", operation.Add)...)
+
+		if len(itemViolations) != 0 {
+			violations = append(violations, itemViolations...)
+			results[i] = batchItemResult{
+				BatchItemResult: models.BatchItemResult{User: operation.User},
+				Error:           &Error{Code: http.StatusBadRequest, Status: StatusValidationFailed, Message: "Wrong operation format", Details: itemViolations},
+			}
+			continue
+		}
+		operations = append(operations, operation)
+		positions = append(positions, i)
+	}
+
+	if len(violations) != 0 && !partial {
+		app.errorWrongFormat(w, violations...)
+		return
+	}
+
+	stored, err := app.storage.UpdateSegmentsBatch(r.Context(), operations, strict, partial)
+	var unknownErr *storage.UnknownSegmentsError
+	if errors.As(err, &unknownErr) {
+		var details validator.Violations
+		for i, operation := range form.Operations {
+			details = append(details, unknownSegmentsViolations(fmt.Sprintf("operations[%d].list_add", i), operation.Add, unknownErr.Slugs)...)
+		}
+		app.errorUnprocessable(w, StatusUnknownSegments, "Segments do not exist: "+strings.Join(unknownErr.Slugs, ", "), details...)
+		return
+	}
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegmentsBatch: error updating data in storage", err,
+		)
+		app.errorStorage(w, err)
+		return
+	}
+
+	result := batchResult{Results: results}
+	for j, item := range stored {
+		i := positions[j]
+		results[i] = batchItemResult{BatchItemResult: item}
+		if item.Err != nil {
+			e := storageError(item.Err)
+			if errors.As(item.Err, &unknownErr) {
+				e.Details = unknownSegmentsViolations(fmt.Sprintf("operations[%d].list_add", i), form.Operations[i].Add, unknownErr.Slugs)
+			}
+			results[i].Error = &e
+		}
+	}
+	for _, item := range results {
+		if item.Applied {
+			result.Applied++
+		} else {
+			result.Failed++
+		}
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		app.logger.Errorw("error",
+			"updateSegmentsBatch: error converting result to json", err,
+		)
+		app.errorInternalServer(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+type updateSegmentsBatchForm struct {
+	Operations []models.BatchOperation `json:"operations"`
+}
+
+// batchResult - результат пакетного запроса, results идут в том же порядке, что и операции в запросе
+type batchResult struct {
+	Applied int               `json:"applied"`
+	Failed  int               `json:"failed"`
+	Results []batchItemResult `json:"results"`
+}
+
+type batchItemResult struct {
+	models.BatchItemResult
+	Error *Error `json:"error,omitempty"`
+}
+
+func (app *application) parseUserID(userStr string) (int64, validator.Violations) {
+	user, err := strconv.ParseInt(userStr, 10, 64)
+	if err != nil {
+		return 0, validator.Violations{{
+			Field:   "user_id",
+			Rule:    "type",
+			Value:   userStr,
+			Message: "user_id must be an integer",
+		}}
+	}
+	return user, app.validator.UserId("user_id", user)
+}
+
+func unknownSegmentsViolations(field string, segments []models.Segment, unknown []string) validator.Violations {
+	unknownSet := make(map[string]bool, len(unknown))
+	for _, slug := range unknown {
+		unknownSet[slug] = true
+	}
+
+	var violations validator.Violations
+	for i, segment := range segments {
+		if unknownSet[segment.Slug] {
+			violations = append(violations, validator.Violation{
+				Field:   fmt.Sprintf("%s[%d].segment_slug", field, i),
+				Rule:    "exists",
+				Value:   segment.Slug,
+				Message: fmt.Sprintf("segment %s does not exist", segment.Slug),
+			})
+		}
+	}
+	return violations
+}
+
+// С параметром lenient=true отсутствующий пользователь или сегмент не считается ошибкой, как раньше
+func parseLenient(r *http.Request) (bool, validator.Violations) {
+	return parseBoolQuery(r, "lenient", false)
+}
+
+// Логический параметр запроса, если он не передан, то используется значение по умолчанию
+func parseBoolQuery(r *http.Request, name string, defaultValue bool) (bool, validator.Violations) {
+	valueStr := r.URL.Query().Get(name)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue, validator.Violations{{
+			Field:   name,
+			Rule:    "type",
+			Value:   valueStr,
+			Message: name + " must be true or false",
+		}}
+	}
+	return value, nil
+}
+
+// Целочисленный параметр запроса, если он не передан, то используется значение по умолчанию
+func parseIntQuery(r *http.Request, name string, defaultValue int64) (int64, validator.Violations) {
+	valueStr := r.URL.Query().Get(name)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseInt(valueStr, 10, 64)
+	if err != nil {
+		return defaultValue, validator.Violations{{
+			Field:   name,
+			Rule:    "type",
+			Value:   valueStr,
+			Message: name + " must be an integer",
+		}}
+	}
+	return value, nil
+}
+
+func (app *application) listTooLong(length int) bool {
+	return app.limits.MaxListLength > 0 && length > app.limits.MaxListLength
 }
@@ -11,17 +11,26 @@ import (
 	"github.com/h3ll0kitt1/avitotest/internal/config"
 	"github.com/h3ll0kitt1/avitotest/internal/file"
 	"github.com/h3ll0kitt1/avitotest/internal/logger"
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/ratelimit"
 	"github.com/h3ll0kitt1/avitotest/internal/storage"
+	"github.com/h3ll0kitt1/avitotest/internal/storage/cache"
 	"github.com/h3ll0kitt1/avitotest/internal/storage/sql"
 	"github.com/h3ll0kitt1/avitotest/internal/validator"
 )
 
 type application struct {
-	storage   storage.Storage
-	router    *chi.Mux
-	file      file.File
-	logger    *zap.SugaredLogger
-	validator validator.Validator
+	storage        storage.Storage
+	router         *chi.Mux
+	file           file.File
+	logger         *zap.SugaredLogger
+	validator      validator.Validator
+	limiter        ratelimit.Limiter
+	limits         config.Limits
+	idempotencyTTL time.Duration
+	strict         bool
+	archiveGrace   time.Duration
+	erasure        models.ErasurePolicy
 }
 
 // @title Avito Test API
@@ -37,28 +46,51 @@ func main() {
 		log.Fatalf("Error %s load configuration", err)
 	}
 
+	if len(cfg.Command) != 0 {
+		l := logger.NewLogger()
+		defer l.Sync()
+
+		if cfg.Command[0] != "migrate" {
+			log.Fatalf("Error unknown command %s, %s", cfg.Command[0], migrateUsage)
+		}
+		err = runMigrate(cfg.Database, cfg.Command[1:], l)
+		if err != nil {
+			log.Fatalf("Error %s running migrations", err)
+		}
+		return
+	}
+
 	r := chi.NewRouter()
 	f := file.NewCSV(cfg.Filename)
 	v := validator.New()
 	l := logger.NewLogger()
+	rl := ratelimit.NewTokenBucket(cfg.Limits.RateLimit, cfg.Limits.RateBurst)
 
 	defer l.Sync()
 
-	s, err := sql.NewStorage(cfg.Database, l)
+	s, err := sql.NewStorage(cfg.Database, cfg.History, cfg.Rules, l)
 	if err != nil {
 		log.Fatalf("Error %s open database", err)
 	}
+	defer s.Close()
 
 	app := &application{
-		storage:   s,
-		router:    r,
-		file:      f,
-		logger:    l,
-		validator: v,
+		storage:        newCachedStorage(s, cfg.Cache, l),
+		router:         r,
+		file:           f,
+		logger:         l,
+		validator:      v,
+		limiter:        rl,
+		limits:         cfg.Limits,
+		idempotencyTTL: cfg.IdempotencyTTL,
+		strict:         cfg.StrictSegments,
+		archiveGrace:   cfg.ArchiveGrace,
+		erasure:        models.ErasurePolicy(cfg.UserErasure),
 	}
 	app.setRouters()
 
 	go app.cleanupExpiredSegments(cfg.Database.CheckInterval)
+	go app.recomputeRuleSegments(cfg.Rules.Interval)
 
 	srv := &http.Server{
 		Addr:    cfg.Addr,
@@ -70,9 +102,35 @@ func main() {
 	}
 }
 
+// Кэш сегментов пользователя оборачивает хранилище, если он включен в конфигурации
+func newCachedStorage(s storage.Storage, cfg config.Cache, logger *zap.SugaredLogger) storage.Storage {
+	switch cfg.Backend {
+	case "local":
+		return cache.New(s, cache.NewLRU(cfg.Size), cfg.TTL, logger)
+	case "redis":
+		return cache.New(s, cache.NewRedis(cfg.RedisAddr, cfg.RedisPassword, "avitotest:segments:", 16), cfg.TTL, logger)
+	default:
+		return s
+	}
+}
+
 func (app *application) cleanupExpiredSegments(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	for range ticker.C {
 		app.storage.DeleteExpiredSegments()
+		app.storage.DeleteExpiredIdempotencyKeys()
+		app.storage.FailStaleImportJobs()
+		app.storage.PurgeArchivedSegments(app.archiveGrace)
+		app.storage.CreateHistoryPartitions()
+		app.storage.ArchiveHistory()
+	}
+}
+
+// Материализованные сегменты с правилом пересчитываются чаще, чем выполняется очистка,
+// чтобы изменение атрибутов пользователя быстро отражалось в его сегментах
+func (app *application) recomputeRuleSegments(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		app.storage.RecomputeRuleSegments()
 	}
 }
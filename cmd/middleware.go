@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/validator"
+)
+
+// Клиент определяется по API ключу, если ключ известен, а иначе по IP адресу.
+// Заголовок не проверяется на подлинность, поэтому произвольные ключи не должны
+// давать клиенту новое ведро токенов
+func (app *application) clientKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if _, ok := app.limits.APIKeys[key]; ok {
+			return "key:" + key
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (app *application) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := app.clientKey(r)
+		ok, retryAfter := app.limiter.Allow(client)
+		if !ok {
+			app.logger.Infow("info",
+				"limitRate: too many requests from client", client,
+			)
+			app.errorTooManyRequests(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.limits.MaxBodyBytes > 0 {
+			if r.ContentLength > app.limits.MaxBodyBytes {
+				app.errorTooLarge(w)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, app.limits.MaxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// Повторный запрос с тем же заголовком Idempotency-Key не выполняется заново,
+// вместо этого клиенту возвращается сохраненный ответ на первый запрос
+func (app *application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if idempotencyKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(idempotencyKey) > 255 {
+			app.errorWrongFormat(w, validator.Violation{
+				Field:   "Idempotency-Key",
+				Rule:    "max_length",
+				Value:   idempotencyKey,
+				Message: "Idempotency-Key exceeds 255 characters",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			app.logger.Errorw("error",
+				"idempotent: error reading request body", err,
+			)
+			app.errorRequestBody(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Ключ действует только в рамках одного клиента и одного ресурса
+		keyHash := sha256.Sum256([]byte(app.clientKey(r) + " " + r.Method + " " + r.URL.Path + " " + idempotencyKey))
+		bodyHash := sha256.Sum256(body)
+
+		record := models.IdempotencyRecord{
+			Key:         hex.EncodeToString(keyHash[:]),
+			RequestHash: hex.EncodeToString(bodyHash[:]),
+			ExpiresAt:   time.Now().Add(app.idempotencyTTL),
+		}
+
+		stored, reserved, err := app.storage.ReserveIdempotencyKey(r.Context(), record)
+		if err != nil {
+			app.logger.Errorw("error",
+				"idempotent: error reserving idempotency key", err,
+			)
+			app.errorStorage(w, err)
+			return
+		}
+
+		if !reserved {
+			if stored.RequestHash != record.RequestHash {
+				app.errorUnprocessable(w, StatusIdempotencyKeyMismatch, "Idempotency-Key was already used with another request body")
+				return
+			}
+			if stored.StatusCode == 0 {
+				app.errorConflict(w, StatusIdempotencyInProgress, "Request with this Idempotency-Key is still being processed")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		// Если обработчик завершился паникой, ключ освобождается до того, как паника
+		// дойдет до http.Server, иначе повторы с этим ключом получали бы 409 до истечения срока
+		defer func() {
+			if p := recover(); p != nil {
+				app.releaseIdempotencyKey(record.Key)
+				panic(p)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Ответы с ошибкой сервера не сохраняем, чтобы клиент мог повторить запрос.
+		// Ошибку клиента после его отключения тоже не сохраняем: она могла быть вызвана
+		// отменой контекста, а не самим запросом
+		canceled := r.Context().Err() != nil && rec.statusCode >= http.StatusBadRequest
+		if rec.statusCode == 0 || rec.statusCode >= http.StatusInternalServerError || canceled {
+			app.releaseIdempotencyKey(record.Key)
+			return
+		}
+
+		if err := app.storage.SaveIdempotencyResponse(context.Background(), record.Key, rec.statusCode, rec.body.Bytes()); err != nil {
+			app.logger.Errorw("error",
+				"idempotent: error saving response for idempotency key", err,
+			)
+		}
+	})
+}
+
+func (app *application) releaseIdempotencyKey(key string) {
+	if err := app.storage.DeleteIdempotencyKey(context.Background(), key); err != nil {
+		app.logger.Errorw("error",
+			"idempotent: error releasing idempotency key", err,
+		)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/ratelimit"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+	"github.com/h3ll0kitt1/avitotest/internal/validator"
+)
+
+// fakeLimiter запоминает ключи клиентов и пропускает только первые allow запросов
+type fakeLimiter struct {
+	allow int
+	keys  []string
+}
+
+func (l *fakeLimiter) Allow(key string) (bool, time.Duration) {
+	l.keys = append(l.keys, key)
+	return len(l.keys) <= l.allow, 1500 * time.Millisecond
+}
+
+func newTestApplication(limits config.Limits, limiter ratelimit.Limiter) *application {
+	return &application{
+		logger:    zap.NewNop().Sugar(),
+		validator: validator.New(),
+		limiter:   limiter,
+		limits:    limits,
+	}
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestClientKey(t *testing.T) {
+	app := newTestApplication(config.Limits{
+		APIKeys: map[string]struct{}{"known": {}},
+	}, nil)
+
+	tests := []struct {
+		name   string
+		apiKey string
+		want   string
+	}{
+		{name: "known key", apiKey: "known", want: "key:known"},
+		{name: "unknown key", apiKey: "random", want: "ip:10.0.0.1"},
+		{name: "no key", apiKey: "", want: "ip:10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/segments/", nil)
+			r.RemoteAddr = "10.0.0.1:5555"
+			if tt.apiKey != "" {
+				r.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if got := app.clientKey(r); got != tt.want {
+				t.Errorf("clientKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	limiter := &fakeLimiter{allow: 1}
+	app := newTestApplication(config.Limits{}, limiter)
+	handler := app.limitRate(http.HandlerFunc(okHandler))
+
+	// Случайные ключи не дают отдельного ведра: оба запроса учитываются по IP адресу
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/segments/", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		r.Header.Set("X-API-Key", strings.Repeat("x", i+1))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+		if limiter.keys[i] != "ip:10.0.0.1" {
+			t.Errorf("request %d: limiter key = %q, want ip:10.0.0.1", i, limiter.keys[i])
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/segments/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if !strings.Contains(w.Body.String(), StatusRateLimited) {
+		t.Errorf("body = %s, want status %s", w.Body.String(), StatusRateLimited)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	app := newTestApplication(config.Limits{MaxBodyBytes: 10}, nil)
+
+	// Обработчик читает тело целиком, как это делает json.Decoder
+	handler := app.limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		for {
+			_, err := r.Body.Read(buf)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				app.errorRequestBody(w, err)
+				return
+			}
+		}
+	}))
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		want          int
+	}{
+		{name: "small body", body: "0123456789", contentLength: 10, want: http.StatusOK},
+		{name: "declared length too large", body: "0123456789a", contentLength: 11, want: http.StatusRequestEntityTooLarge},
+		{name: "unknown length too large", body: "0123456789a", contentLength: -1, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/segments/test", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxListLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		body  string
+		want  int
+	}{
+		{name: "list too long", limit: 2, body: `{"user_list":[1,2,3]}`, want: http.StatusRequestEntityTooLarge},
+		{name: "segments too long", limit: 1, body: `{"segment_list":["A","B"]}`, want: http.StatusRequestEntityTooLarge},
+		{name: "limit disabled", limit: 0, body: `{"user_list":[1,2,3],"days":0}`, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(config.Limits{MaxListLength: tt.limit}, nil)
+
+			r := httptest.NewRequest(http.MethodGet, "/history/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			app.getHistory(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// idempotencyStorage резервирует любой ключ и запоминает, сохранен ли ответ или ключ освобожден
+type idempotencyStorage struct {
+	storage.Storage
+	saved    int
+	released []string
+}
+
+func (s *idempotencyStorage) ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, bool, error) {
+	return record, true, nil
+}
+
+func (s *idempotencyStorage) SaveIdempotencyResponse(ctx context.Context, key string, statusCode int, body []byte) error {
+	s.saved = statusCode
+	return nil
+}
+
+func (s *idempotencyStorage) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	s.released = append(s.released, key)
+	return nil
+}
+
+func TestIdempotentReleasesKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		cancel   bool
+		panics   bool
+		released bool
+		saved    int
+	}{
+		{
+			name:    "success is saved",
+			handler: okHandler,
+			saved:   http.StatusOK,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			released: true,
+		},
+		{
+			name:     "no response",
+			handler:  func(w http.ResponseWriter, r *http.Request) {},
+			released: true,
+		},
+		{
+			name: "panic",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("handler failed")
+			},
+			panics:   true,
+			released: true,
+		},
+		{
+			name: "client disconnected",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusConflict)
+			},
+			cancel:   true,
+			released: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &idempotencyStorage{}
+			app := newTestApplication(config.Limits{}, nil)
+			app.storage = s
+			app.idempotencyTTL = time.Hour
+
+			r := httptest.NewRequest(http.MethodPost, "/segments/test", strings.NewReader("{}"))
+			r.Header.Set("Idempotency-Key", "key")
+			if tt.cancel {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+
+			func() {
+				defer func() {
+					if p := recover(); (p != nil) != tt.panics {
+						t.Errorf("panic = %v, want panic %v", p, tt.panics)
+					}
+				}()
+				app.idempotent(tt.handler).ServeHTTP(w, r)
+			}()
+
+			if got := len(s.released) == 1; got != tt.released {
+				t.Errorf("released = %v, want %v", got, tt.released)
+			}
+			if s.saved != tt.saved {
+				t.Errorf("saved status = %d, want %d", s.saved, tt.saved)
+			}
+		})
+	}
+}
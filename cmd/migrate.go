@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+	"github.com/h3ll0kitt1/avitotest/internal/storage/sql"
+)
+
+const migrateUsage = "usage: main [flags] migrate up | down [steps] | status"
+
+// Подкоманда migrate: up применяет все новые миграции, down откатывает последние steps миграций (по умолчанию одну),
+// status выводит все миграции и время их применения
+func runMigrate(cfg config.Database, args []string, logger *zap.SugaredLogger) error {
+
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	steps := 1
+	switch {
+	case args[0] == "down" && len(args) == 2:
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 1 {
+			return errors.New(migrateUsage)
+		}
+	case len(args) != 1:
+		return errors.New(migrateUsage)
+	}
+
+	m, err := sql.NewMigrator(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied migrations: %d\n", applied)
+	case "down":
+		rolledBack, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rolled back migrations: %d\n", rolledBack)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Disabled {
+				appliedAt = "disabled"
+			}
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -6,19 +6,45 @@ import (
 
 func (app *application) setRouters() {
 
+	app.router.Use(app.limitRate, app.limitBody)
+
 	app.router.Route("/", func(r chi.Router) {
 		app.router.Get("/history/", app.getHistory)
 
 		app.router.Route("/segments", func(router chi.Router) {
 
-			router.Post("/{slug}", app.createSegment)
+			router.Get("/", app.listSegments)
+			router.Get("/{slug}", app.getSegment)
+			router.With(app.idempotent).Post("/{slug}", app.createSegment)
+			router.Patch("/{slug}", app.updateSegment)
 			router.Delete("/{slug}", app.deleteSegment)
+			router.Post("/{slug}/rename", app.renameSegment)
+			router.Post("/{slug}/restore", app.restoreSegment)
+			router.Post("/{slug}/recompute", app.recomputeSegment)
+			router.With(app.idempotent).Post("/{slug}/users/import", app.importSegmentUsers)
+			router.Get("/{slug}/users/import/{job_id}", app.getImportJob)
+		})
+
+		app.router.With(app.idempotent).Post("/users-segments:batch", app.updateSegmentsBatch)
+		app.router.Post("/users-segments:lookup", app.lookupSegments)
+
+		app.router.Post("/users:import", app.importUsers)
+
+		app.router.Route("/users", func(router chi.Router) {
+
+			router.Get("/", app.listUsers)
+			router.Post("/", app.createUser)
+			router.Get("/{user_id}", app.getUser)
+			router.Put("/{user_id}/attributes", app.updateUserAttributes)
+			router.Patch("/{user_id}/attributes", app.updateUserAttributes)
+			router.Delete("/{user_id}", app.deleteUser)
 		})
 
 		app.router.Route("/users-segments", func(router chi.Router) {
 
 			router.Get("/{user_id}", app.getSegments)
-			router.Put("/{user_id}", app.updateSegments)
+			router.Get("/{user_id}/{slug}", app.getMembership)
+			router.With(app.idempotent).Put("/{user_id}", app.updateSegments)
 		})
 
 	})
@@ -5,13 +5,25 @@ import (
 	"flag"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Addr     string
-	Filename string
-	Database Database
+	Addr           string
+	Filename       string
+	Database       Database
+	Limits         Limits
+	IdempotencyTTL time.Duration
+	StrictSegments bool
+	ArchiveGrace   time.Duration
+	Cache          Cache
+	History        History
+	UserErasure    string
+	Rules          Rules
+
+	// Command - аргументы после флагов, например migrate up
+	Command []string
 }
 
 type Database struct {
@@ -21,6 +33,60 @@ type Database struct {
 	POSTGRES_PORT     string
 	DATABASE_HOST     string
 	CheckInterval     time.Duration
+
+	// Параметры пула соединений, нулевой StatementTimeout снимает ограничение на время запроса,
+	// нулевой StatementCache отключает кэширование подготовленных запросов
+	MaxConns         int32
+	MinConns         int32
+	MaxConnLifetime  time.Duration
+	MaxConnIdleTime  time.Duration
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+	StatementCache   int
+	ConnectRetries   int
+
+	// AutoMigrate применяет миграции схемы при старте сервиса
+	AutoMigrate bool
+
+	// HistoryPartitioning переводит историю в таблицу, секционированную по месяцам
+	HistoryPartitioning bool
+}
+
+// Cache описывает кэш сегментов пользователя, пустой Backend отключает кэш
+type Cache struct {
+	Backend       string
+	TTL           time.Duration
+	Size          int
+	RedisAddr     string
+	RedisPassword string
+}
+
+// History задает срок хранения истории, нулевой Retention хранит историю бессрочно. Записи старше Retention
+// переносятся в архив: table - в таблицу segments_history_archive, file - в файлы NDJSON.gz в ArchiveDir,
+// none - удаляются без архива. Из архива записи удаляются через ArchiveRetention, если он не нулевой
+type History struct {
+	Retention        time.Duration
+	Archive          string
+	ArchiveDir       string
+	ArchiveRetention time.Duration
+	BatchSize        int
+}
+
+// Rules задает пересчет материализованных сегментов с правилом: фоновая задача каждые Interval пересчитывает
+// измененные сегменты и пользователей с измененными атрибутами пачками по BatchSize пользователей
+type Rules struct {
+	Interval  time.Duration
+	BatchSize int
+}
+
+type Limits struct {
+	RateLimit     float64
+	RateBurst     int
+	MaxBodyBytes  int64
+	MaxListLength int
+	// Известные API ключи. Лимит по ключу действует только для них,
+	// запросы с неизвестным ключом ограничиваются по IP адресу
+	APIKeys map[string]struct{}
 }
 
 func NewConfig() (*Config, error) {
@@ -30,6 +96,36 @@ func NewConfig() (*Config, error) {
 		flagRunAddr       string
 		flagFilename      string
 		flagDatabaseHost  string
+		flagRateLimit     float64
+		flagRateBurst     int
+		flagMaxBodyBytes  int64
+		flagMaxListLength int
+		flagAPIKeys       string
+		flagIdempotency   int
+		flagStrict        bool
+		flagArchiveGrace  int
+		flagCache         string
+		flagCacheTTL      int
+		flagCacheSize     int
+		flagRedisAddr     string
+		flagMaxConns      int
+		flagMinConns      int
+		flagConnLifetime  int
+		flagConnIdleTime  int
+		flagConnTimeout   int
+		flagStmtTimeout   int
+		flagStmtCache     int
+		flagConnRetries   int
+		flagAutoMigrate   bool
+		flagPartitioning  bool
+		flagRetention     int
+		flagArchive       string
+		flagArchiveDir    string
+		flagArchiveKeep   int
+		flagHistoryBatch  int
+		flagUserErasure   string
+		flagRuleInterval  int
+		flagRuleBatch     int
 	)
 
 	var (
@@ -43,6 +139,36 @@ func NewConfig() (*Config, error) {
 	flag.StringVar(&flagRunAddr, "a", "localhost:8080", "address and port to run server")
 	flag.StringVar(&flagDatabaseHost, "d", "localhost", "host to run database")
 	flag.StringVar(&flagFilename, "f", "/tmp/file.csv", "file to download history from app")
+	flag.Float64Var(&flagRateLimit, "rate-limit", 10, "number of requests per second allowed for one client, 0 disables limiting")
+	flag.IntVar(&flagRateBurst, "rate-burst", 20, "number of requests client can send at once")
+	flag.Int64Var(&flagMaxBodyBytes, "max-body", 1<<20, "maximum request body size in bytes")
+	flag.IntVar(&flagMaxListLength, "max-list", 1000, "maximum number of elements in request lists")
+	flag.StringVar(&flagAPIKeys, "api-keys", "", "comma separated list of known api keys")
+	flag.IntVar(&flagIdempotency, "idempotency-ttl", 24, "number of hours to keep responses for idempotency keys")
+	flag.BoolVar(&flagStrict, "strict", false, "reject adding users to segments that do not exist")
+	flag.IntVar(&flagArchiveGrace, "archive-grace", 30, "number of days to keep deleted segments in archive before purging")
+	flag.StringVar(&flagCache, "cache", "", "cache for user segments: local, redis or empty to disable")
+	flag.IntVar(&flagCacheTTL, "cache-ttl", 60, "number of seconds to keep user segments in cache")
+	flag.IntVar(&flagCacheSize, "cache-size", 100000, "maximum number of users in local cache")
+	flag.StringVar(&flagRedisAddr, "redis-addr", "localhost:6379", "address and port of redis for cache")
+	flag.IntVar(&flagMaxConns, "db-max-conns", 20, "maximum number of connections in database pool")
+	flag.IntVar(&flagMinConns, "db-min-conns", 2, "minimum number of idle connections kept in database pool")
+	flag.IntVar(&flagConnLifetime, "db-conn-lifetime", 60, "number of minutes after which database connection is closed")
+	flag.IntVar(&flagConnIdleTime, "db-conn-idle", 30, "number of minutes after which idle database connection is closed")
+	flag.IntVar(&flagConnTimeout, "db-connect-timeout", 5, "number of seconds to wait for database connection")
+	flag.IntVar(&flagStmtTimeout, "db-statement-timeout", 30, "number of seconds statement may run in database, 0 disables limit")
+	flag.IntVar(&flagStmtCache, "db-statement-cache", 512, "number of prepared statements cached per connection, 0 disables caching")
+	flag.IntVar(&flagConnRetries, "db-connect-retries", 5, "number of retries to connect to database at startup")
+	flag.BoolVar(&flagAutoMigrate, "auto-migrate", true, "apply database migrations at startup")
+	flag.BoolVar(&flagPartitioning, "history-partitioning", false, "partition segments history by month")
+	flag.IntVar(&flagRetention, "history-retention", 0, "number of days to keep history before archiving, 0 keeps history forever")
+	flag.StringVar(&flagArchive, "history-archive", "table", "where to move expired history: table, file or none")
+	flag.StringVar(&flagArchiveDir, "history-archive-dir", "/tmp/history-archive", "directory for history archive files")
+	flag.IntVar(&flagArchiveKeep, "history-archive-retention", 0, "number of days to keep history in archive, 0 keeps archive forever")
+	flag.IntVar(&flagHistoryBatch, "history-batch", 5000, "number of history records archived in one transaction")
+	flag.StringVar(&flagUserErasure, "user-erasure", "anonymize", "what to do with history of deleted user: anonymize or purge")
+	flag.IntVar(&flagRuleInterval, "rule-interval", 5, "interval in seconds between recomputations of materialized rule segments")
+	flag.IntVar(&flagRuleBatch, "rule-batch", 1000, "number of users recomputed in one transaction")
 	flag.Parse()
 
 	envCheckInterval, err := strconv.Atoi(os.Getenv("CHECK_INTERVAL"))
@@ -50,6 +176,174 @@ func NewConfig() (*Config, error) {
 		flagCheckInterval = envCheckInterval
 	}
 
+	envRateLimit, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64)
+	if err == nil {
+		flagRateLimit = envRateLimit
+	}
+
+	envRateBurst, err := strconv.Atoi(os.Getenv("RATE_BURST"))
+	if err == nil {
+		flagRateBurst = envRateBurst
+	}
+
+	envMaxBodyBytes, err := strconv.ParseInt(os.Getenv("MAX_BODY_BYTES"), 10, 64)
+	if err == nil {
+		flagMaxBodyBytes = envMaxBodyBytes
+	}
+
+	envMaxListLength, err := strconv.Atoi(os.Getenv("MAX_LIST_LENGTH"))
+	if err == nil {
+		flagMaxListLength = envMaxListLength
+	}
+
+	if envAPIKeys := os.Getenv("API_KEYS"); envAPIKeys != "" {
+		flagAPIKeys = envAPIKeys
+	}
+
+	envIdempotency, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL"))
+	if err == nil {
+		flagIdempotency = envIdempotency
+	}
+
+	envStrict, err := strconv.ParseBool(os.Getenv("STRICT_SEGMENTS"))
+	if err == nil {
+		flagStrict = envStrict
+	}
+
+	envArchiveGrace, err := strconv.Atoi(os.Getenv("ARCHIVE_GRACE_DAYS"))
+	if err == nil {
+		flagArchiveGrace = envArchiveGrace
+	}
+
+	envCacheTTL, err := strconv.Atoi(os.Getenv("CACHE_TTL"))
+	if err == nil {
+		flagCacheTTL = envCacheTTL
+	}
+
+	envCacheSize, err := strconv.Atoi(os.Getenv("CACHE_SIZE"))
+	if err == nil {
+		flagCacheSize = envCacheSize
+	}
+
+	if envCache := os.Getenv("CACHE"); envCache != "" {
+		flagCache = envCache
+	}
+
+	if flagCache != "" && flagCache != "local" && flagCache != "redis" {
+		return nil, errors.New("Unknown cache backend " + flagCache)
+	}
+
+	if envRedisAddr := os.Getenv("REDIS_ADDR"); envRedisAddr != "" {
+		flagRedisAddr = envRedisAddr
+	}
+
+	envMaxConns, err := strconv.Atoi(os.Getenv("DB_MAX_CONNS"))
+	if err == nil {
+		flagMaxConns = envMaxConns
+	}
+
+	envMinConns, err := strconv.Atoi(os.Getenv("DB_MIN_CONNS"))
+	if err == nil {
+		flagMinConns = envMinConns
+	}
+
+	envConnLifetime, err := strconv.Atoi(os.Getenv("DB_CONN_LIFETIME"))
+	if err == nil {
+		flagConnLifetime = envConnLifetime
+	}
+
+	envConnIdleTime, err := strconv.Atoi(os.Getenv("DB_CONN_IDLE"))
+	if err == nil {
+		flagConnIdleTime = envConnIdleTime
+	}
+
+	envConnTimeout, err := strconv.Atoi(os.Getenv("DB_CONNECT_TIMEOUT"))
+	if err == nil {
+		flagConnTimeout = envConnTimeout
+	}
+
+	envStmtTimeout, err := strconv.Atoi(os.Getenv("DB_STATEMENT_TIMEOUT"))
+	if err == nil {
+		flagStmtTimeout = envStmtTimeout
+	}
+
+	envStmtCache, err := strconv.Atoi(os.Getenv("DB_STATEMENT_CACHE"))
+	if err == nil {
+		flagStmtCache = envStmtCache
+	}
+
+	envConnRetries, err := strconv.Atoi(os.Getenv("DB_CONNECT_RETRIES"))
+	if err == nil {
+		flagConnRetries = envConnRetries
+	}
+
+	envAutoMigrate, err := strconv.ParseBool(os.Getenv("AUTO_MIGRATE"))
+	if err == nil {
+		flagAutoMigrate = envAutoMigrate
+	}
+
+	envPartitioning, err := strconv.ParseBool(os.Getenv("HISTORY_PARTITIONING"))
+	if err == nil {
+		flagPartitioning = envPartitioning
+	}
+
+	envRetention, err := strconv.Atoi(os.Getenv("HISTORY_RETENTION_DAYS"))
+	if err == nil {
+		flagRetention = envRetention
+	}
+
+	if envArchive := os.Getenv("HISTORY_ARCHIVE"); envArchive != "" {
+		flagArchive = envArchive
+	}
+
+	if envArchiveDir := os.Getenv("HISTORY_ARCHIVE_DIR"); envArchiveDir != "" {
+		flagArchiveDir = envArchiveDir
+	}
+
+	envArchiveKeep, err := strconv.Atoi(os.Getenv("HISTORY_ARCHIVE_RETENTION_DAYS"))
+	if err == nil {
+		flagArchiveKeep = envArchiveKeep
+	}
+
+	envHistoryBatch, err := strconv.Atoi(os.Getenv("HISTORY_BATCH_SIZE"))
+	if err == nil {
+		flagHistoryBatch = envHistoryBatch
+	}
+
+	if flagArchive != "table" && flagArchive != "file" && flagArchive != "none" {
+		return nil, errors.New("Unknown history archive " + flagArchive)
+	}
+
+	if flagRetention < 0 || flagHistoryBatch < 1 || (flagArchiveKeep != 0 && flagArchiveKeep < flagRetention) {
+		return nil, errors.New("Wrong history retention, expected history-archive-retention >= history-retention >= 0 and history-batch >= 1")
+	}
+
+	if envUserErasure := os.Getenv("USER_ERASURE"); envUserErasure != "" {
+		flagUserErasure = envUserErasure
+	}
+
+	if flagUserErasure != "anonymize" && flagUserErasure != "purge" {
+		return nil, errors.New("Unknown user erasure policy " + flagUserErasure)
+	}
+
+	envRuleInterval, err := strconv.Atoi(os.Getenv("RULE_INTERVAL"))
+	if err == nil {
+		flagRuleInterval = envRuleInterval
+	}
+
+	envRuleBatch, err := strconv.Atoi(os.Getenv("RULE_BATCH_SIZE"))
+	if err == nil {
+		flagRuleBatch = envRuleBatch
+	}
+
+	if flagRuleInterval < 1 || flagRuleBatch < 1 {
+		return nil, errors.New("Wrong rule recomputation, expected rule-interval >= 1 and rule-batch >= 1")
+	}
+
+	if flagMaxConns < 1 || flagMinConns < 0 || flagMinConns > flagMaxConns {
+		return nil, errors.New("Wrong database pool size, expected 0 <= db-min-conns <= db-max-conns and db-max-conns >= 1")
+	}
+
 	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
 		flagRunAddr = envRunAddr
 	}
@@ -81,19 +375,80 @@ func NewConfig() (*Config, error) {
 	addr := flagRunAddr
 	filename := flagFilename
 	checkInterval := time.Duration(flagCheckInterval) * time.Minute
+	idempotencyTTL := time.Duration(flagIdempotency) * time.Hour
+	archiveGrace := time.Duration(flagArchiveGrace) * 24 * time.Hour
+
+	cache := Cache{
+		Backend:       flagCache,
+		TTL:           time.Duration(flagCacheTTL) * time.Second,
+		Size:          flagCacheSize,
+		RedisAddr:     flagRedisAddr,
+		RedisPassword: os.Getenv("REDIS_PASSWORD"),
+	}
+
+	history := History{
+		Retention:        time.Duration(flagRetention) * 24 * time.Hour,
+		Archive:          flagArchive,
+		ArchiveDir:       flagArchiveDir,
+		ArchiveRetention: time.Duration(flagArchiveKeep) * 24 * time.Hour,
+		BatchSize:        flagHistoryBatch,
+	}
+
+	rules := Rules{
+		Interval:  time.Duration(flagRuleInterval) * time.Second,
+		BatchSize: flagRuleBatch,
+	}
 
 	database := Database{
-		POSTGRES_DB:       envPOSTGRES_DB,
-		POSTGRES_USER:     envPOSTGRES_USER,
-		POSTGRES_PORT:     envPOSTGRES_PORT,
-		POSTGRES_PASSWORD: envPOSTGRES_PASSWORD,
-		DATABASE_HOST:     flagDatabaseHost,
-		CheckInterval:     checkInterval,
+		POSTGRES_DB:         envPOSTGRES_DB,
+		POSTGRES_USER:       envPOSTGRES_USER,
+		POSTGRES_PORT:       envPOSTGRES_PORT,
+		POSTGRES_PASSWORD:   envPOSTGRES_PASSWORD,
+		DATABASE_HOST:       flagDatabaseHost,
+		CheckInterval:       checkInterval,
+		MaxConns:            int32(flagMaxConns),
+		MinConns:            int32(flagMinConns),
+		MaxConnLifetime:     time.Duration(flagConnLifetime) * time.Minute,
+		MaxConnIdleTime:     time.Duration(flagConnIdleTime) * time.Minute,
+		ConnectTimeout:      time.Duration(flagConnTimeout) * time.Second,
+		StatementTimeout:    time.Duration(flagStmtTimeout) * time.Second,
+		StatementCache:      flagStmtCache,
+		ConnectRetries:      flagConnRetries,
+		AutoMigrate:         flagAutoMigrate,
+		HistoryPartitioning: flagPartitioning,
+	}
+
+	limits := Limits{
+		RateLimit:     flagRateLimit,
+		RateBurst:     flagRateBurst,
+		MaxBodyBytes:  flagMaxBodyBytes,
+		MaxListLength: flagMaxListLength,
+		APIKeys:       parseAPIKeys(flagAPIKeys),
 	}
 
 	return &Config{
-		Addr:     addr,
-		Database: database,
-		Filename: filename,
+		Addr:           addr,
+		Database:       database,
+		Filename:       filename,
+		Limits:         limits,
+		IdempotencyTTL: idempotencyTTL,
+		StrictSegments: flagStrict,
+		ArchiveGrace:   archiveGrace,
+		Cache:          cache,
+		History:        history,
+		UserErasure:    flagUserErasure,
+		Rules:          rules,
+		Command:        flag.Args(),
 	}, nil
 }
+
+func parseAPIKeys(list string) map[string]struct{} {
+	keys := make(map[string]struct{})
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
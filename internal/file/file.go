@@ -36,15 +36,29 @@ func (f *FileCSV) Download(history []models.History) (string, error) {
 		row = append(row, user)
 		row = append(row, record.Segment.Slug)
 
-		if record.Action {
+		switch record.Action {
+		case models.ActionAdd:
 			row = append(row, "добавление")
-		}
-
-		if !record.Action {
+		case models.ActionRemove:
 			row = append(row, "удаление")
+		case models.ActionTTLUpdate:
+			row = append(row, "обновление TTL")
+		case models.ActionRename:
+			row = append(row, "переименование")
+		case models.ActionArchive:
+			row = append(row, "архивирование")
+		case models.ActionRestore:
+			row = append(row, "восстановление")
 		}
 
 		row = append(row, record.ActionTime)
+
+		switch record.Reason {
+		case models.ReasonRule:
+			row = append(row, "правило")
+		default:
+			row = append(row, "")
+		}
 		writer.Write(row)
 	}
 	writer.Flush()
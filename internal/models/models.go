@@ -1,13 +1,224 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Segment struct {
-	Slug    string `json:"segment_slug"`
-	DaysTTL int    `json:"days_ttl,omitempty"`
+	Slug      string     `json:"segment_slug"`
+	DaysTTL   int        `json:"days_ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Membership - состояние пользователя в сегменте, ExpiresAt и JoinedAt заполнены только для активного участия,
+// JoinedAt может отсутствовать для пользователей, добавленных до появления этого поля
+type Membership struct {
+	User      int64      `json:"user_id"`
+	Slug      string     `json:"segment_slug"`
+	Member    bool       `json:"member"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	JoinedAt  *time.Time `json:"joined_at,omitempty"`
+}
+
+// SegmentInfo - сегмент вместе с описанием, владельцем, тегами и произвольными атрибутами.
+// Если задано правило Rule, то в сегменте также состоят все пользователи, атрибуты которых подходят под правило.
+// Для материализованного сегмента членство по правилу хранится вместе с явным и пересчитывается фоновой задачей.
+// Если задан состав Composition, то в сегменте также состоят пользователи, полученные операцией над другими сегментами
+type SegmentInfo struct {
+	Slug         string          `json:"segment_slug"`
+	Description  string          `json:"description"`
+	Owner        string          `json:"owner"`
+	Tags         []string        `json:"tags"`
+	Attributes   json.RawMessage `json:"attributes,omitempty" swaggertype:"object"`
+	Rule         string          `json:"rule,omitempty"`
+	Materialized bool            `json:"materialized,omitempty"`
+	Composition  *Composition    `json:"composition,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"`
+}
+
+// SegmentPatch содержит только те поля сегмента, которые нужно изменить, nil означает "не менять",
+// пустое правило и состав без операции делают сегмент обычным
+type SegmentPatch struct {
+	Description  *string          `json:"description,omitempty"`
+	Owner        *string          `json:"owner,omitempty"`
+	Tags         *[]string        `json:"tags,omitempty"`
+	Attributes   *json.RawMessage `json:"attributes,omitempty" swaggertype:"object"`
+	Rule         *string          `json:"rule,omitempty"`
+	Materialized *bool            `json:"materialized,omitempty"`
+	Composition  *Composition     `json:"composition,omitempty"`
+}
+
+// SetOperation - операция над сегментами, из которых составлен сегмент
+type SetOperation string
+
+const (
+	SetUnion      SetOperation = "union"
+	SetIntersect  SetOperation = "intersect"
+	SetDifference SetOperation = "difference"
+)
+
+// Composition - состав сегмента: объединение или пересечение сегментов Segments, а для разности -
+// пользователи первого сегмента, которые не состоят ни в одном из остальных
+type Composition struct {
+	Operation SetOperation `json:"operation" enums:"union,intersect,difference"`
+	Segments  []string     `json:"segments"`
+}
+
+type Action string
+
+const (
+	ActionAdd       Action = "add"
+	ActionRemove    Action = "remove"
+	ActionTTLUpdate Action = "ttl_update"
+	ActionRename    Action = "rename"
+	ActionArchive   Action = "archive"
+	ActionRestore   Action = "restore"
+)
+
+// HistoryFilter задает выгрузку истории пользователей за последние Days дней,
+// если Segments не пуст, то только по этим сегментам (включая их прежние названия),
+// IncludeArchive добавляет записи, перенесенные в архив по сроку хранения
+type HistoryFilter struct {
+	Users          []int64
+	Segments       []string
+	Days           int
+	IncludeArchive bool
 }
 
+// Reason - причина изменения в истории, пустая для изменений через API
+type Reason string
+
+const (
+	ReasonRule Reason = "rule"
+)
+
 type History struct {
 	User       int64
 	Segment    Segment
-	Action     bool
+	Action     Action
 	ActionTime string
+	Reason     Reason
+}
+
+// UpdateResult описывает изменения, которые действительно произошли с сегментами пользователя,
+// Ignored содержит сегменты из списка на удаление, в которых пользователь не состоял,
+// Segments - все активные сегменты пользователя после обновления
+type UpdateResult struct {
+	Added      []Segment `json:"added"`
+	TTLUpdated []Segment `json:"ttl_updated"`
+	Removed    []Segment `json:"removed"`
+	Ignored    []Segment `json:"ignored"`
+	Segments   []Segment `json:"segments"`
+}
+
+// BatchOperation - изменение сегментов одного пользователя в пакетном запросе
+type BatchOperation struct {
+	User   int64     `json:"user_id"`
+	Delete []Segment `json:"list_delete,omitempty"`
+	Add    []Segment `json:"list_add,omitempty"`
+}
+
+// BatchItemResult - результат одной операции пакетного запроса, Err заполнен, если операция не была применена
+type BatchItemResult struct {
+	User    int64 `json:"user_id"`
+	Applied bool  `json:"applied"`
+	UpdateResult
+	Err error `json:"-"`
+}
+
+type ImportMode string
+
+const (
+	ImportAdd    ImportMode = "add"
+	ImportRemove ImportMode = "remove"
+)
+
+type ImportStatus string
+
+const (
+	ImportPending ImportStatus = "pending"
+	ImportRunning ImportStatus = "running"
+	ImportDone    ImportStatus = "done"
+	ImportFailed  ImportStatus = "failed"
+)
+
+// ImportRow - строка загруженного файла, Line - номер строки в файле
+type ImportRow struct {
+	Line    int
+	User    int64
+	DaysTTL int
+}
+
+// ImportJob - задача импорта пользователей в сегмент, ChangedRows - число пользователей,
+// которые действительно были добавлены, удалены или у которых изменился TTL
+type ImportJob struct {
+	ID            int64        `json:"job_id"`
+	Slug          string       `json:"segment_slug"`
+	Mode          ImportMode   `json:"mode"`
+	Status        ImportStatus `json:"status"`
+	TotalRows     int          `json:"total_rows"`
+	ProcessedRows int          `json:"processed_rows"`
+	ChangedRows   int          `json:"changed_rows"`
+	Error         string       `json:"error,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+type CreateSegmentResult struct {
+	Created    bool  `json:"created"`
+	UsersAdded int64 `json:"users_added"`
+}
+
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// User - зарегистрированный пользователь с произвольными атрибутами, по которым вычисляются правила сегментов.
+// CreatedAt может отсутствовать для пользователей, появившихся до учета времени регистрации
+type User struct {
+	ID         int64           `json:"user_id"`
+	CreatedAt  *time.Time      `json:"created_at,omitempty"`
+	Attributes json.RawMessage `json:"attributes" swaggertype:"object"`
+}
+
+// CreateUserResult - пользователь и признак того, что он был зарегистрирован этим запросом
+type CreateUserResult struct {
+	User
+	Created bool `json:"created"`
+}
+
+// UserImportResult - число новых пользователей и пользователей, которые уже были зарегистрированы
+type UserImportResult struct {
+	Registered int64 `json:"registered"`
+	Existing   int64 `json:"existing"`
+}
+
+// RecomputeResult - число пользователей, добавленных в сегмент и удаленных из него при пересчете правила
+type RecomputeResult struct {
+	Added   int64 `json:"added"`
+	Removed int64 `json:"removed"`
+}
+
+// ErasurePolicy определяет, что происходит с историей удаляемого пользователя:
+// anonymize заменяет идентификатор пользователя на 0, purge удаляет записи
+type ErasurePolicy string
+
+const (
+	ErasureAnonymize ErasurePolicy = "anonymize"
+	ErasurePurge     ErasurePolicy = "purge"
+)
+
+// UserErasure - результат удаления пользователя, HistoryRecords - число обезличенных или удаленных записей истории
+type UserErasure struct {
+	User               int64         `json:"user_id"`
+	Policy             ErasurePolicy `json:"policy"`
+	MembershipsRemoved int64         `json:"memberships_removed"`
+	HistoryRecords     int64         `json:"history_records"`
 }
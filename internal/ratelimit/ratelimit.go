@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type Limiter interface {
+	Allow(key string) (bool, time.Duration)
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// TokenBucket хранит отдельное ведро токенов для каждого клиента (API ключ или IP)
+type TokenBucket struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	idle      time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewTokenBucket создает лимитер, пополняющий ведро со скоростью rate токенов в секунду
+// и вмещающий не более burst токенов. Если rate равен 0, то ограничение отключено
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		idle:    10 * time.Minute,
+		now:     time.Now,
+	}
+}
+
+// Allow списывает токен из ведра клиента. Если токенов нет, то возвращает время,
+// через которое токен появится
+func (tb *TokenBucket) Allow(key string) (bool, time.Duration) {
+	if tb.rate <= 0 {
+		return true, 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.now()
+	tb.sweep(now)
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.burst, lastSeen: now}
+		tb.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(tb.burst, b.tokens+elapsed*tb.rate)
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / tb.rate * float64(time.Second))
+	return false, wait
+}
+
+// Удаляем ведра клиентов, которые давно не присылали запросов, чтобы карта не росла бесконечно
+func (tb *TokenBucket) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < tb.idle {
+		return
+	}
+	for key, b := range tb.buckets {
+		if now.Sub(b.lastSeen) >= tb.idle {
+			delete(tb.buckets, key)
+		}
+	}
+	tb.lastSweep = now
+}
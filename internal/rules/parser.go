@@ -0,0 +1,316 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value any
+	pos   int
+}
+
+// SyntaxError - ошибка разбора правила, Pos - позиция в символах от начала правила
+type SyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("rule syntax error at position %d: %s", e.Pos, e.Message)
+}
+
+func tokenize(source string) ([]token, error) {
+
+	runes := []rune(source)
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, &SyntaxError{Pos: i, Message: "unknown operator " + op + ", expected == or !="}
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+
+		case r == '"' || r == '\'':
+			value, end, err := readString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[i:end]), value: value, pos: i})
+			i = end
+
+		case r == '-' || unicode.IsDigit(r):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			text := string(runes[i:end])
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, &SyntaxError{Pos: i, Message: "wrong number " + text}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value, pos: i})
+			i = end
+
+		case r == '_' || unicode.IsLetter(r):
+			end := i + 1
+			for end < len(runes) && (runes[end] == '_' || runes[end] == '.' || unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[i:end]), pos: i})
+			i = end
+
+		default:
+			return nil, &SyntaxError{Pos: i, Message: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// Строка в двойных или одинарных кавычках, внутри кавычка и обратная косая черта экранируются обратной косой чертой
+func readString(runes []rune, start int) (string, int, error) {
+
+	quote := runes[start]
+	var value strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\\':
+			if i+1 == len(runes) {
+				return "", 0, &SyntaxError{Pos: i, Message: "unterminated string"}
+			}
+			i++
+			value.WriteRune(runes[i])
+		default:
+			value.WriteRune(runes[i])
+		}
+	}
+	return "", 0, &SyntaxError{Pos: start, Message: "unterminated string"}
+}
+
+// Разбор рекурсивным спуском, приоритет операций по возрастанию: or, and, not, сравнение
+//
+//	expr       = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" expr ")" | comparison
+//	comparison = attribute operator literal | attribute [ "not" ] "in" "(" literal { "," literal } ")"
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// Ключевые слова не зависят от регистра
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenIdent && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, unexpected(t, what)
+	}
+	return t, nil
+}
+
+func unexpected(t token, expected string) error {
+	if t.kind == tokenEOF {
+		return &SyntaxError{Pos: t.pos, Message: "unexpected end of rule, expected " + expected}
+	}
+	return &SyntaxError{Pos: t.pos, Message: fmt.Sprintf("unexpected %s, expected %s", t.text, expected)}
+}
+
+func (p *parser) parseExpr() (node, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+
+	if p.keyword("not") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.next()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokenRParen, ")")
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+
+	attr, err := p.expect(tokenIdent, "attribute name")
+	if err != nil {
+		return nil, err
+	}
+	if isKeyword(attr.text) {
+		return nil, unexpected(attr, "attribute name")
+	}
+
+	negate := p.keyword("not")
+	if negate || p.keyword("in") {
+		if negate && !p.keyword("in") {
+			return nil, unexpected(p.peek(), "in")
+		}
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{attr: attr.text, values: values, negate: negate}, nil
+	}
+
+	op, err := p.expect(tokenOperator, "comparison operator or in")
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{attr: attr.text, op: op.text, value: value}, nil
+}
+
+func (p *parser) parseList() ([]any, error) {
+
+	_, err := p.expect(tokenLParen, "(")
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, 0)
+	for {
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		t := p.next()
+		if t.kind == tokenRParen {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, unexpected(t, ", or )")
+		}
+	}
+}
+
+func (p *parser) parseLiteral() (any, error) {
+
+	t := p.next()
+	switch {
+	case t.kind == tokenString || t.kind == tokenNumber:
+		return t.value, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "true"):
+		return true, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "false"):
+		return false, nil
+	default:
+		return nil, unexpected(t, "string, number, true or false")
+	}
+}
+
+func isKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not", "in", "true", "false":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package rules
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		rule    string
+		pos     int
+		message string
+	}{
+		{``, 0, "unexpected end of rule, expected attribute name"},
+		{`city`, 4, "unexpected end of rule, expected comparison operator or in"},
+		{`city = "SPb"`, 5, "unknown operator =, expected == or !="},
+		{`city ! "SPb"`, 5, "unknown operator !, expected == or !="},
+		{`city == `, 8, "unexpected end of rule, expected string, number, true or false"},
+		{`city == SPb`, 8, "unexpected SPb, expected string, number, true or false"},
+		{`city == "SPb`, 8, "unterminated string"},
+		{`city == "SPb\`, 12, "unterminated string"},
+		{`age == 1.2.3`, 7, "wrong number 1.2.3"},
+		{`age == -`, 7, "wrong number -"},
+		{`city == "SPb" and`, 17, "unexpected end of rule, expected attribute name"},
+		{`city == "SPb" city == "Moscow"`, 14, "unexpected city, expected and, or or end of rule"},
+		{`(city == "SPb"`, 14, "unexpected end of rule, expected )"},
+		{`city == "SPb")`, 13, "unexpected ), expected and, or or end of rule"},
+		{`and == 1`, 0, "unexpected and, expected attribute name"},
+		{`city not ("SPb")`, 9, "unexpected (, expected in"},
+		{`city in "SPb"`, 8, "unexpected \"SPb\", expected ("},
+		{`city in ("SPb" "Moscow")`, 15, "unexpected \"Moscow\", expected , or )"},
+		{`city in ()`, 9, "unexpected ), expected string, number, true or false"},
+		{`city == "SPb" & age > 1`, 14, "unexpected character '&'"},
+		// Позиция считается в символах, а не в байтах
+		{`город == "Москва" и`, 18, "unexpected и, expected and, or or end of rule"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := Parse(tt.rule)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected syntax error, got %v", err)
+			}
+			if syntaxErr.Pos != tt.pos || syntaxErr.Message != tt.message {
+				t.Errorf("got error at %d: %s, want at %d: %s", syntaxErr.Pos, syntaxErr.Message, tt.pos, tt.message)
+			}
+		})
+	}
+}
+
+func TestTokenizeStrings(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`"abc"`, "abc"},
+		{`'abc'`, "abc"},
+		{`""`, ""},
+		{`"it's"`, "it's"},
+		{`'say "hi"'`, `say "hi"`},
+		{`"a\"b"`, `a"b`},
+		{`"a\\b"`, `a\b`},
+		{`"a\nb"`, "anb"},
+	}
+
+	for _, tt := range tests {
+		tokens, err := tokenize(tt.source)
+		if err != nil {
+			t.Errorf("tokenize %s: %v", tt.source, err)
+			continue
+		}
+		if len(tokens) != 2 || tokens[0].kind != tokenString || tokens[0].value != tt.want {
+			t.Errorf("tokenize %s = %+v, want string %q", tt.source, tokens, tt.want)
+		}
+	}
+}
+
+func TestParseKeepsSource(t *testing.T) {
+	source := `city in ("Moscow", "SPb") and platform == "ios"`
+	rule, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.String() != source {
+		t.Errorf("String() = %q, want %q", rule.String(), source)
+	}
+}
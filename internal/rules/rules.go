@@ -0,0 +1,209 @@
+package rules
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule - разобранное правило динамического сегмента над атрибутами пользователя, например
+//
+//	city in ("Moscow", "SPb") and platform == "ios" and app_version >= "5.2"
+//
+// Поддерживаются сравнения ==, !=, <, <=, >, >=, проверки in и not in, логические and, or, not и скобки.
+// Значения - строки в двойных или одинарных кавычках, числа, true и false
+type Rule struct {
+	source string
+	root   node
+}
+
+// Parse разбирает правило, ошибка разбора имеет тип *SyntaxError
+func Parse(source string) (*Rule, error) {
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, unexpected(t, "and, or or end of rule")
+	}
+	return &Rule{source: source, root: root}, nil
+}
+
+// Match проверяет, подходят ли атрибуты пользователя под правило. Атрибуты - JSON объект,
+// декодированный в map[string]any. Любое сравнение с отсутствующим атрибутом или со значением другого типа ложно
+func (r *Rule) Match(attributes map[string]any) bool {
+	return r.root.eval(attributes)
+}
+
+func (r *Rule) String() string {
+	return r.source
+}
+
+type node interface {
+	eval(attributes map[string]any) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(attributes map[string]any) bool {
+	return n.left.eval(attributes) || n.right.eval(attributes)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(attributes map[string]any) bool {
+	return n.left.eval(attributes) && n.right.eval(attributes)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(attributes map[string]any) bool {
+	return !n.operand.eval(attributes)
+}
+
+type compareNode struct {
+	attr  string
+	op    string
+	value any
+}
+
+func (n compareNode) eval(attributes map[string]any) bool {
+
+	actual, ok := attributes[n.attr]
+	if !ok {
+		return false
+	}
+
+	cmp, ok := compare(actual, n.value)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// not in, как и !=, ложно для отсутствующего атрибута и для атрибута, тип которого не совпадает
+// ни с одним значением списка, в отличие от not, примененного к in
+type inNode struct {
+	attr   string
+	values []any
+	negate bool
+}
+
+func (n inNode) eval(attributes map[string]any) bool {
+
+	actual, ok := attributes[n.attr]
+	if !ok {
+		return false
+	}
+
+	comparable := false
+	for _, value := range n.values {
+		cmp, ok := compare(actual, value)
+		if !ok {
+			continue
+		}
+		if cmp == 0 {
+			return !n.negate
+		}
+		comparable = true
+	}
+	return n.negate && comparable
+}
+
+// Версии вида 5.10.1 сравниваются по числовым компонентам, поэтому 5.10 больше 5.9
+var versionExpr = regexp.MustCompile(`^\d+(\.\d+)+$`)
+
+// Сравниваем значение атрибута со значением из правила, второй результат ложен, если значения разных типов.
+// Числа в JSON декодируются в float64, строки сравниваются посимвольно, поэтому даты в формате ISO 8601
+// сравниваются по времени
+func compare(actual any, expected any) (int, bool) {
+
+	switch expected := expected.(type) {
+	case float64:
+		actual, ok := actual.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case actual < expected:
+			return -1, true
+		case actual > expected:
+			return 1, true
+		}
+		return 0, true
+
+	case string:
+		actual, ok := actual.(string)
+		if !ok {
+			return 0, false
+		}
+		if versionExpr.MatchString(actual) && versionExpr.MatchString(expected) {
+			return compareVersions(actual, expected), true
+		}
+		return strings.Compare(actual, expected), true
+
+	case bool:
+		actual, ok := actual.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case actual == expected:
+			return 0, true
+		case !actual:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// Недостающие компоненты версии считаются нулями, поэтому 5.2 и 5.2.0 равны
+func compareVersions(a string, b string) int {
+
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y uint64
+		if i < len(partsA) {
+			x, _ = strconv.ParseUint(partsA[i], 10, 64)
+		}
+		if i < len(partsB) {
+			y, _ = strconv.ParseUint(partsB[i], 10, 64)
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
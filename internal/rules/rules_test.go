@@ -0,0 +1,111 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func attributes(t *testing.T, data string) map[string]any {
+	t.Helper()
+	var attrs map[string]any
+	err := json.Unmarshal([]byte(data), &attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attrs
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       string
+		attributes string
+		want       bool
+	}{
+		// Приоритет: not выше and, and выше or
+		{"and before or", `a == 1 or a == 2 and b == 3`, `{"a": 1, "b": 0}`, true},
+		{"and before or, right side", `a == 1 or a == 2 and b == 3`, `{"a": 2, "b": 0}`, false},
+		{"parentheses", `(a == 1 or a == 2) and b == 3`, `{"a": 1, "b": 0}`, false},
+		{"not before and", `not a == 1 and b == 2`, `{"a": 2, "b": 2}`, true},
+		{"not applies to one comparison", `not a == 1 and b == 2`, `{"a": 1, "b": 3}`, false},
+		{"double not", `not not a == 1`, `{"a": 1}`, true},
+		{"keywords ignore case", `A == 1 AND NOT b == 2 Or c == 3`, `{"A": 1, "b": 1}`, true},
+
+		// Сравнения
+		{"number equal", `age == 30`, `{"age": 30}`, true},
+		{"number less", `age < 30`, `{"age": 29.5}`, true},
+		{"negative number", `balance >= -10`, `{"balance": -5}`, true},
+		{"string not equal", `city != "SPb"`, `{"city": "Moscow"}`, true},
+		{"string order", `name < "b"`, `{"name": "abc"}`, true},
+		{"iso date", `registered >= "2023-01-01"`, `{"registered": "2023-08-30"}`, true},
+		{"bool", `premium == true`, `{"premium": true}`, true},
+		{"bool false", `premium == FALSE`, `{"premium": true}`, false},
+		{"dotted attribute", `device.os == "ios"`, `{"device.os": "ios"}`, true},
+
+		// Версии сравниваются по числовым компонентам
+		{"version numeric components", `app_version > "5.9"`, `{"app_version": "5.10"}`, true},
+		{"version missing components", `app_version == "5.2"`, `{"app_version": "5.2.0"}`, true},
+		{"version less", `app_version < "5.2.1"`, `{"app_version": "5.2"}`, true},
+		{"not a version compares as string", `app_version > "5.9"`, `{"app_version": "5.10-beta"}`, false},
+
+		// in и not in
+		{"in", `city in ("Moscow", 'SPb')`, `{"city": "SPb"}`, true},
+		{"in miss", `city in ("Moscow", "SPb")`, `{"city": "Kazan"}`, false},
+		{"in numbers", `age in (18, 21)`, `{"age": 21}`, true},
+		{"not in", `city not in ("Moscow", "SPb")`, `{"city": "Kazan"}`, true},
+		{"not in hit", `city not in ("Moscow", "SPb")`, `{"city": "Moscow"}`, false},
+		{"in mixed types", `age in ("18", 18)`, `{"age": 18}`, true},
+		{"not in mixed types", `age not in ("18", 19)`, `{"age": 18}`, true},
+
+		// Отсутствующий атрибут и несовпадающие типы
+		{"missing attribute equal", `city == "SPb"`, `{}`, false},
+		{"missing attribute not equal", `city != "SPb"`, `{}`, false},
+		{"missing attribute in", `city in ("SPb")`, `{}`, false},
+		{"missing attribute not in", `city not in ("SPb")`, `{}`, false},
+		{"missing attribute negated comparison", `not city == "SPb"`, `{}`, true},
+		{"missing attribute negated in", `not city in ("SPb")`, `{}`, true},
+		{"type mismatch equal", `age == "30"`, `{"age": 30}`, false},
+		{"type mismatch not equal", `age != "30"`, `{"age": 30}`, false},
+		{"type mismatch in", `age in ("30")`, `{"age": 30}`, false},
+		{"type mismatch not in", `age not in ("30", true)`, `{"age": 30}`, false},
+		{"type mismatch bool", `premium == 1`, `{"premium": true}`, false},
+		{"null attribute", `city == "SPb"`, `{"city": null}`, false},
+
+		// Кавычки и экранирование
+		{"single quotes", `name == 'O"Brien'`, `{"name": "O\"Brien"}`, true},
+		{"escaped quote", `name == 'O\'Brien'`, `{"name": "O'Brien"}`, true},
+		{"escaped backslash", `path == "a\\b"`, `{"path": "a\\b"}`, true},
+		{"unicode string", `city == "Москва"`, `{"city": "Москва"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatalf("parse %q: %v", tt.rule, err)
+			}
+			if got := rule.Match(attributes(t, tt.attributes)); got != tt.want {
+				t.Errorf("%s on %s = %v, want %v", tt.rule, tt.attributes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"5.10", "5.9", 1},
+		{"5.2", "5.2.0", 0},
+		{"5.2.0.1", "5.2", 1},
+		{"1.0", "1.0.1", -1},
+		{"10.0", "9.99", 1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// Backend хранит закэшированные значения и счетчики поколений, реализации: LRU в памяти процесса и Redis
+type Backend interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Counters возвращает значения счетчиков, отсутствующий счетчик равен 0
+	Counters(ctx context.Context, keys ...string) ([]int64, error)
+	// Incr увеличивает счетчики и продлевает их срок жизни до ttl
+	Incr(ctx context.Context, ttl time.Duration, keys ...string) error
+}
+
+// Storage кэширует сегменты пользователя поверх любого storage.Storage. Все изменяющие методы
+// сбрасывают затронутые записи кэша, остальные методы передаются хранилищу без изменений.
+// Окончательное удаление архивных сегментов кэш не затрагивает, так как архивные сегменты уже скрыты.
+//
+// Записи не удаляются, а сбрасываются сменой поколения: ключ записи содержит общий счетчик поколения
+// и счетчик поколения пользователя, которые прочитаны до чтения из базы. Сброс увеличивает счетчик,
+// поэтому значение, прочитанное до сброса, записывается под старым ключом и больше не читается.
+// Счетчики хранятся в том же хранилище, что и записи, и для Redis общие для всех экземпляров сервиса
+type Storage struct {
+	storage.Storage
+
+	backend Backend
+	ttl     time.Duration
+	logger  *zap.SugaredLogger
+	now     func() time.Time
+}
+
+// New оборачивает хранилище кэшем, записи живут не дольше ttl и не дольше ближайшего expires_at
+func New(next storage.Storage, backend Backend, ttl time.Duration, logger *zap.SugaredLogger) *Storage {
+	return &Storage{
+		Storage: next,
+		backend: backend,
+		ttl:     ttl,
+		logger:  logger,
+		now:     time.Now,
+	}
+}
+
+const allGenerationKey = "gen"
+
+func generationKey(user int64) string {
+	return "gen:user:" + strconv.FormatInt(user, 10)
+}
+
+func userKey(user int64, generations []int64) string {
+	key := "user:" + strconv.FormatInt(user, 10)
+	for _, generation := range generations {
+		key += ":" + strconv.FormatInt(generation, 10)
+	}
+	return key
+}
+
+// Счетчик должен пережить любую запись, сделанную под его предыдущим значением,
+// иначе после истечения счетчика старая запись снова стала бы доступна
+func (c *Storage) generationTTL() time.Duration {
+	return c.ttl + time.Minute
+}
+
+func (c *Storage) GetSegmentsByUserID(ctx context.Context, user int64) ([]models.Segment, error) {
+	// Без поколения нельзя отличить свежую запись от устаревшей, поэтому читаем из базы без кэша
+	generations, err := c.backend.Counters(ctx, allGenerationKey, generationKey(user))
+	if err != nil {
+		c.logger.Errorw("error",
+			"GetSegmentsByUserID: reading cache generation failed ", err,
+		)
+		return c.Storage.GetSegmentsByUserID(ctx, user)
+	}
+	key := userKey(user, generations)
+
+	data, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		c.logger.Errorw("error",
+			"GetSegmentsByUserID: reading cache failed ", err,
+		)
+	}
+	if ok {
+		var segments []models.Segment
+		err = json.Unmarshal(data, &segments)
+		if err == nil {
+			return segments, nil
+		}
+		c.logger.Errorw("error",
+			"GetSegmentsByUserID: decoding cached segments failed ", err,
+		)
+	}
+
+	segments, err := c.Storage.GetSegmentsByUserID(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := c.entryTTL(segments)
+	if ttl <= 0 {
+		return segments, nil
+	}
+
+	data, err = json.Marshal(segments)
+	if err != nil {
+		c.logger.Errorw("error",
+			"GetSegmentsByUserID: encoding segments failed ", err,
+		)
+		return segments, nil
+	}
+	err = c.backend.Set(ctx, key, data, ttl)
+	if err != nil {
+		c.logger.Errorw("error",
+			"GetSegmentsByUserID: writing cache failed ", err,
+		)
+	}
+	return segments, nil
+}
+
+// Запись не должна пережить сегмент с ближайшим сроком окончания
+func (c *Storage) entryTTL(segments []models.Segment) time.Duration {
+	ttl := c.ttl
+	now := c.now()
+	for _, segment := range segments {
+		if segment.ExpiresAt != nil && segment.ExpiresAt.Sub(now) < ttl {
+			ttl = segment.ExpiresAt.Sub(now)
+		}
+	}
+	return ttl
+}
+
+func (c *Storage) invalidate(ctx context.Context, users ...int64) {
+	if len(users) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(users))
+	for _, user := range users {
+		keys = append(keys, generationKey(user))
+	}
+	err := c.backend.Incr(ctx, c.generationTTL(), keys...)
+	if err != nil {
+		c.logger.Errorw("error",
+			"invalidate: incrementing cache generations failed ", err,
+		)
+	}
+}
+
+func (c *Storage) invalidateAll(ctx context.Context) {
+	err := c.backend.Incr(ctx, c.generationTTL(), allGenerationKey)
+	if err != nil {
+		c.logger.Errorw("error",
+			"invalidateAll: incrementing cache generation failed ", err,
+		)
+	}
+}
+
+// Случайные пользователи добавляются в сегмент только при переданном проценте,
+// а пользователи по правилу или составу - только для сегмента с правилом или составом
+func (c *Storage) CreateSegment(ctx context.Context, segment models.SegmentInfo, PercentageRND int) (models.CreateSegmentResult, error) {
+	result, err := c.Storage.CreateSegment(ctx, segment, PercentageRND)
+	if PercentageRND != 0 || segment.Rule != "" || segment.Composition != nil {
+		c.invalidateAll(context.Background())
+	}
+	return result, err
+}
+
+// Изменение правила, режима или состава меняет сегменты всех подходящих под него пользователей
+func (c *Storage) UpdateSegment(ctx context.Context, slug string, patch models.SegmentPatch) (models.SegmentInfo, error) {
+	segment, err := c.Storage.UpdateSegment(ctx, slug, patch)
+	if patch.Rule != nil || patch.Materialized != nil || patch.Composition != nil {
+		c.invalidateAll(context.Background())
+	}
+	return segment, err
+}
+
+func (c *Storage) DeleteSegment(ctx context.Context, slug string) error {
+	err := c.Storage.DeleteSegment(ctx, slug)
+	c.invalidateAll(context.Background())
+	return err
+}
+
+func (c *Storage) RestoreSegment(ctx context.Context, slug string) error {
+	err := c.Storage.RestoreSegment(ctx, slug)
+	c.invalidateAll(context.Background())
+	return err
+}
+
+func (c *Storage) RenameSegment(ctx context.Context, slug string, newSlug string) error {
+	err := c.Storage.RenameSegment(ctx, slug, newSlug)
+	c.invalidateAll(context.Background())
+	return err
+}
+
+func (c *Storage) UpdateSegmentsByUserID(ctx context.Context, user int64, deleteList []models.Segment, addList []models.Segment, strict bool) (models.UpdateResult, error) {
+	result, err := c.Storage.UpdateSegmentsByUserID(ctx, user, deleteList, addList, strict)
+	c.invalidate(context.Background(), user)
+	return result, err
+}
+
+func (c *Storage) UpdateSegmentsBatch(ctx context.Context, operations []models.BatchOperation, strict bool, partial bool) ([]models.BatchItemResult, error) {
+	results, err := c.Storage.UpdateSegmentsBatch(ctx, operations, strict, partial)
+
+	users := make([]int64, 0, len(operations))
+	for _, operation := range operations {
+		users = append(users, operation.User)
+	}
+	c.invalidate(context.Background(), users...)
+	return results, err
+}
+
+// Задача импорта применяет файл частями, поэтому до ее завершения кэш может отставать не больше чем на ttl
+func (c *Storage) RunImportJob(job models.ImportJob, rows []models.ImportRow) {
+	c.Storage.RunImportJob(job, rows)
+
+	users := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		users = append(users, row.User)
+	}
+	c.invalidate(context.Background(), users...)
+}
+
+func (c *Storage) UpdateUserAttributes(ctx context.Context, user int64, attributes json.RawMessage, merge bool) (models.User, error) {
+	result, err := c.Storage.UpdateUserAttributes(ctx, user, attributes, merge)
+	c.invalidate(context.Background(), user)
+	return result, err
+}
+
+func (c *Storage) DeleteUser(ctx context.Context, user int64, policy models.ErasurePolicy) (models.UserErasure, error) {
+	erasure, err := c.Storage.DeleteUser(ctx, user, policy)
+	c.invalidate(context.Background(), user)
+	return erasure, err
+}
+
+func (c *Storage) DeleteExpiredSegments() []int64 {
+	users := c.Storage.DeleteExpiredSegments()
+	c.invalidate(context.Background(), users...)
+	return users
+}
+
+func (c *Storage) RecomputeSegment(ctx context.Context, slug string) (models.RecomputeResult, error) {
+	result, err := c.Storage.RecomputeSegment(ctx, slug)
+	c.invalidateAll(context.Background())
+	return result, err
+}
+
+func (c *Storage) RecomputeRuleSegments() []int64 {
+	users := c.Storage.RecomputeRuleSegments()
+	c.invalidate(context.Background(), users...)
+	return users
+}
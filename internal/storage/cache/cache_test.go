@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// fakeStorage возвращает заданные сегменты и считает чтения, остальные методы ничего не делают.
+// Вызов метода, который не переопределен, паникует на встроенном nil интерфейсе
+type fakeStorage struct {
+	storage.Storage
+
+	segments map[int64][]models.Segment
+	reads    int
+	onRead   func()
+}
+
+func (f *fakeStorage) GetSegmentsByUserID(_ context.Context, user int64) ([]models.Segment, error) {
+	f.reads++
+	if f.onRead != nil {
+		f.onRead()
+	}
+	return f.segments[user], nil
+}
+
+func (f *fakeStorage) CreateSegment(context.Context, models.SegmentInfo, int) (models.CreateSegmentResult, error) {
+	return models.CreateSegmentResult{}, nil
+}
+
+func (f *fakeStorage) UpdateSegment(context.Context, string, models.SegmentPatch) (models.SegmentInfo, error) {
+	return models.SegmentInfo{}, nil
+}
+
+func (f *fakeStorage) DeleteSegment(context.Context, string) error { return nil }
+
+func (f *fakeStorage) RestoreSegment(context.Context, string) error { return nil }
+
+func (f *fakeStorage) RenameSegment(context.Context, string, string) error { return nil }
+
+func (f *fakeStorage) UpdateSegmentsByUserID(context.Context, int64, []models.Segment, []models.Segment, bool) (models.UpdateResult, error) {
+	return models.UpdateResult{}, nil
+}
+
+func (f *fakeStorage) UpdateSegmentsBatch(context.Context, []models.BatchOperation, bool, bool) ([]models.BatchItemResult, error) {
+	return nil, nil
+}
+
+func (f *fakeStorage) RunImportJob(models.ImportJob, []models.ImportRow) {}
+
+func (f *fakeStorage) UpdateUserAttributes(context.Context, int64, json.RawMessage, bool) (models.User, error) {
+	return models.User{}, nil
+}
+
+func (f *fakeStorage) DeleteUser(context.Context, int64, models.ErasurePolicy) (models.UserErasure, error) {
+	return models.UserErasure{}, nil
+}
+
+func (f *fakeStorage) DeleteExpiredSegments() []int64 { return []int64{1} }
+
+func (f *fakeStorage) RecomputeSegment(context.Context, string) (models.RecomputeResult, error) {
+	return models.RecomputeResult{}, nil
+}
+
+func (f *fakeStorage) RecomputeRuleSegments() []int64 { return []int64{1} }
+
+// recordingBackend запоминает срок жизни последней записи
+type recordingBackend struct {
+	*LRU
+	lastTTL time.Duration
+	sets    int
+}
+
+func (b *recordingBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	b.lastTTL = ttl
+	b.sets++
+	return b.LRU.Set(ctx, key, value, ttl)
+}
+
+func newTestCache(next *fakeStorage) (*Storage, *recordingBackend) {
+	backend := &recordingBackend{LRU: NewLRU(100)}
+	return New(next, backend, time.Minute, zap.NewNop().Sugar()), backend
+}
+
+// cached проверяет, есть ли запись пользователя для текущих поколений
+func cached(t *testing.T, backend Backend, user int64) bool {
+	t.Helper()
+	ctx := context.Background()
+	generations, err := backend.Counters(ctx, allGenerationKey, generationKey(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := backend.Get(ctx, userKey(user, generations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	next := &fakeStorage{segments: map[int64][]models.Segment{1: {{Slug: "SEG1"}}}}
+	c, _ := newTestCache(next)
+
+	for i := 0; i < 3; i++ {
+		segments, err := c.GetSegmentsByUserID(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 1 || segments[0].Slug != "SEG1" {
+			t.Fatalf("unexpected segments %v", segments)
+		}
+	}
+	if next.reads != 1 {
+		t.Errorf("storage read %d times, want 1", next.reads)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	ctx := context.Background()
+	rule := "city == \"Moscow\""
+	materialized := true
+	description := "new"
+
+	tests := []struct {
+		name string
+		// Сбрасывается ли запись пользователя 1 и запись постороннего пользователя 2
+		user, other bool
+		mutate      func(c *Storage)
+	}{
+		{"create plain segment", false, false, func(c *Storage) {
+			c.CreateSegment(ctx, models.SegmentInfo{Slug: "S"}, 0)
+		}},
+		{"create segment with random users", true, true, func(c *Storage) {
+			c.CreateSegment(ctx, models.SegmentInfo{Slug: "S"}, 10)
+		}},
+		{"create segment with rule", true, true, func(c *Storage) {
+			c.CreateSegment(ctx, models.SegmentInfo{Slug: "S", Rule: rule}, 0)
+		}},
+		{"create segment with composition", true, true, func(c *Storage) {
+			c.CreateSegment(ctx, models.SegmentInfo{Slug: "S", Composition: &models.Composition{Operation: models.SetUnion, Segments: []string{"A", "B"}}}, 0)
+		}},
+		{"update description", false, false, func(c *Storage) {
+			c.UpdateSegment(ctx, "S", models.SegmentPatch{Description: &description})
+		}},
+		{"update rule", true, true, func(c *Storage) {
+			c.UpdateSegment(ctx, "S", models.SegmentPatch{Rule: &rule})
+		}},
+		{"update materialization", true, true, func(c *Storage) {
+			c.UpdateSegment(ctx, "S", models.SegmentPatch{Materialized: &materialized})
+		}},
+		{"update composition", true, true, func(c *Storage) {
+			c.UpdateSegment(ctx, "S", models.SegmentPatch{Composition: &models.Composition{}})
+		}},
+		{"delete segment", true, true, func(c *Storage) { c.DeleteSegment(ctx, "S") }},
+		{"restore segment", true, true, func(c *Storage) { c.RestoreSegment(ctx, "S") }},
+		{"rename segment", true, true, func(c *Storage) { c.RenameSegment(ctx, "S", "T") }},
+		{"recompute segment", true, true, func(c *Storage) { c.RecomputeSegment(ctx, "S") }},
+		{"update user segments", true, false, func(c *Storage) {
+			c.UpdateSegmentsByUserID(ctx, 1, nil, []models.Segment{{Slug: "S"}}, false)
+		}},
+		{"batch update", true, false, func(c *Storage) {
+			c.UpdateSegmentsBatch(ctx, []models.BatchOperation{{User: 1}}, false, false)
+		}},
+		{"import job", true, false, func(c *Storage) {
+			c.RunImportJob(models.ImportJob{Slug: "S"}, []models.ImportRow{{User: 1}})
+		}},
+		{"update user attributes", true, false, func(c *Storage) {
+			c.UpdateUserAttributes(ctx, 1, json.RawMessage(`{}`), true)
+		}},
+		{"delete user", true, false, func(c *Storage) {
+			c.DeleteUser(ctx, 1, models.ErasureAnonymize)
+		}},
+		{"delete expired segments", true, false, func(c *Storage) { c.DeleteExpiredSegments() }},
+		{"recompute rule segments", true, false, func(c *Storage) { c.RecomputeRuleSegments() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &fakeStorage{segments: map[int64][]models.Segment{1: {{Slug: "SEG1"}}, 2: {{Slug: "SEG2"}}}}
+			c, backend := newTestCache(next)
+			c.GetSegmentsByUserID(ctx, 1)
+			c.GetSegmentsByUserID(ctx, 2)
+
+			tt.mutate(c)
+
+			if got := !cached(t, backend, 1); got != tt.user {
+				t.Errorf("user entry invalidated = %v, want %v", got, tt.user)
+			}
+			if got := !cached(t, backend, 2); got != tt.other {
+				t.Errorf("other user entry invalidated = %v, want %v", got, tt.other)
+			}
+		})
+	}
+}
+
+func TestEntryTTLCappedByExpiresAt(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 30, 12, 0, 0, 0, time.UTC)
+	soon := now.Add(10 * time.Second)
+	later := now.Add(time.Hour)
+
+	next := &fakeStorage{segments: map[int64][]models.Segment{
+		1: {{Slug: "PERMANENT"}, {Slug: "LATER", ExpiresAt: &later}, {Slug: "SOON", ExpiresAt: &soon}},
+		2: {{Slug: "PERMANENT"}, {Slug: "LATER", ExpiresAt: &later}},
+	}}
+	c, backend := newTestCache(next)
+	c.now = func() time.Time { return now }
+
+	c.GetSegmentsByUserID(ctx, 1)
+	if backend.lastTTL != 10*time.Second {
+		t.Errorf("ttl with expiring segment = %v, want 10s", backend.lastTTL)
+	}
+
+	c.GetSegmentsByUserID(ctx, 2)
+	if backend.lastTTL != time.Minute {
+		t.Errorf("ttl with distant expiration = %v, want 1m", backend.lastTTL)
+	}
+}
+
+func TestNoCacheWriteForExpiredSegment(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 30, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Second)
+
+	next := &fakeStorage{segments: map[int64][]models.Segment{1: {{Slug: "EXPIRED", ExpiresAt: &past}}}}
+	c, backend := newTestCache(next)
+	c.now = func() time.Time { return now }
+
+	c.GetSegmentsByUserID(ctx, 1)
+	if backend.sets != 0 {
+		t.Errorf("cache written %d times, want 0", backend.sets)
+	}
+}
+
+func TestNoStaleEntryAfterConcurrentInvalidation(t *testing.T) {
+	ctx := context.Background()
+	next := &fakeStorage{segments: map[int64][]models.Segment{1: {{Slug: "SEG1"}}}}
+	c, backend := newTestCache(next)
+
+	// Изменение завершается, пока значение читается из базы, поэтому прочитанное значение может быть устаревшим
+	next.onRead = func() {
+		c.UpdateSegmentsByUserID(ctx, 1, nil, nil, false)
+	}
+	c.GetSegmentsByUserID(ctx, 1)
+
+	if cached(t, backend, 1) {
+		t.Error("value read before invalidation is visible in cache")
+	}
+
+	next.onRead = nil
+	c.GetSegmentsByUserID(ctx, 1)
+	if !cached(t, backend, 1) {
+		t.Error("value read after invalidation was not cached")
+	}
+}
+
+func TestInvalidationSharedBetweenInstances(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLRU(100)
+	next := &fakeStorage{segments: map[int64][]models.Segment{1: {{Slug: "SEG1"}}}}
+	first := New(next, backend, time.Minute, zap.NewNop().Sugar())
+	second := New(next, backend, time.Minute, zap.NewNop().Sugar())
+
+	// Другой экземпляр сервиса меняет сегменты пользователя, пока первый читает их из базы
+	next.onRead = func() {
+		next.onRead = nil
+		next.segments[1] = []models.Segment{{Slug: "SEG2"}}
+		second.UpdateSegmentsByUserID(ctx, 1, nil, nil, false)
+	}
+	first.GetSegmentsByUserID(ctx, 1)
+
+	for name, c := range map[string]*Storage{"first": first, "second": second} {
+		segments, err := c.GetSegmentsByUserID(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 1 || segments[0].Slug != "SEG2" {
+			t.Errorf("%s instance: got %v, want SEG2", name, segments)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+type lruCounter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// LRU хранит не более size записей в памяти процесса и вытесняет давно не использованные.
+// Счетчики поколений хранятся отдельно и не вытесняются, а удаляются только по сроку жизни:
+// вытесненный счетчик обнулился бы и снова открыл доступ к устаревшим записям
+type LRU struct {
+	mu       sync.Mutex
+	size     int
+	items    map[string]*list.Element
+	order    *list.List
+	counters map[string]lruCounter
+	now      func() time.Time
+}
+
+func NewLRU(size int) *LRU {
+	if size < 1 {
+		size = 1
+	}
+	return &LRU{
+		size:     size,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		counters: make(map[string]lruCounter),
+		now:      time.Now,
+	}
+}
+
+func (l *LRU) Get(_ context.Context, key string) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := element.Value.(*lruEntry)
+	if !l.now().Before(entry.expiresAt) {
+		l.remove(element)
+		return nil, false, nil
+	}
+
+	l.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (l *LRU) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expiresAt := l.now().Add(ttl)
+	if element, ok := l.items[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		l.order.MoveToFront(element)
+		return nil
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+	return nil
+}
+
+func (l *LRU) Counters(_ context.Context, keys ...string) ([]int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	values := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		counter, ok := l.counters[key]
+		if !ok || !now.Before(counter.expiresAt) {
+			values = append(values, 0)
+			continue
+		}
+		values = append(values, counter.value)
+	}
+	return values, nil
+}
+
+func (l *LRU) Incr(_ context.Context, ttl time.Duration, keys ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for _, key := range keys {
+		counter, ok := l.counters[key]
+		if !ok || !now.Before(counter.expiresAt) {
+			counter = lruCounter{}
+		}
+		counter.value++
+		counter.expiresAt = now.Add(ttl)
+		l.counters[key] = counter
+	}
+
+	// Истекшие счетчики удаляем, только когда их становится больше, чем записей,
+	// чтобы не обходить все счетчики при каждом сбросе
+	if len(l.counters) > l.size {
+		for key, counter := range l.counters {
+			if !now.Before(counter.expiresAt) {
+				delete(l.counters, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *LRU) remove(element *list.Element) {
+	l.order.Remove(element)
+	delete(l.items, element.Value.(*lruEntry).key)
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(2)
+
+	l.Set(ctx, "a", []byte("1"), time.Minute)
+	l.Set(ctx, "b", []byte("2"), time.Minute)
+
+	// Чтение делает a последней использованной записью, поэтому вытесняется b
+	if _, ok, _ := l.Get(ctx, "a"); !ok {
+		t.Fatal("a: expected hit")
+	}
+	l.Set(ctx, "c", []byte("3"), time.Minute)
+
+	if _, ok, _ := l.Get(ctx, "b"); ok {
+		t.Error("b: expected eviction")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := l.Get(ctx, key); !ok {
+			t.Errorf("%s: expected hit", key)
+		}
+	}
+}
+
+func TestLRUOverwriteDoesNotGrow(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(2)
+
+	l.Set(ctx, "a", []byte("1"), time.Minute)
+	l.Set(ctx, "b", []byte("2"), time.Minute)
+	l.Set(ctx, "a", []byte("3"), time.Minute)
+
+	value, ok, _ := l.Get(ctx, "a")
+	if !ok || string(value) != "3" {
+		t.Errorf("a: got %q, %v, want 3", value, ok)
+	}
+	if _, ok, _ := l.Get(ctx, "b"); !ok {
+		t.Error("b: expected hit")
+	}
+}
+
+func TestLRUExpiresEntries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 30, 12, 0, 0, 0, time.UTC)
+	l := NewLRU(10)
+	l.now = func() time.Time { return now }
+
+	l.Set(ctx, "a", []byte("1"), 10*time.Second)
+
+	now = now.Add(9 * time.Second)
+	if _, ok, _ := l.Get(ctx, "a"); !ok {
+		t.Fatal("expected hit before ttl")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok, _ := l.Get(ctx, "a"); ok {
+		t.Fatal("expected miss at ttl")
+	}
+	if len(l.items) != 0 || l.order.Len() != 0 {
+		t.Errorf("expired entry was not removed: %d items, %d in order", len(l.items), l.order.Len())
+	}
+}
+
+func TestLRUCounters(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 30, 12, 0, 0, 0, time.UTC)
+	l := NewLRU(1)
+	l.now = func() time.Time { return now }
+
+	l.Incr(ctx, time.Minute, "a", "b")
+	l.Incr(ctx, time.Minute, "a")
+
+	// Записи не вытесняют счетчики, даже если их больше размера кэша
+	l.Set(ctx, "x", []byte("1"), time.Minute)
+	l.Set(ctx, "y", []byte("2"), time.Minute)
+
+	values, err := l.Counters(ctx, "a", "b", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []int64{2, 1, 0}) {
+		t.Errorf("counters = %v, want [2 1 0]", values)
+	}
+
+	now = now.Add(time.Minute)
+	values, _ = l.Counters(ctx, "a", "b")
+	if !reflect.DeepEqual(values, []int64{0, 0}) {
+		t.Errorf("counters after ttl = %v, want [0 0]", values)
+	}
+
+	// Истекшие счетчики удаляются при следующем увеличении
+	l.Incr(ctx, time.Minute, "c")
+	if len(l.counters) != 1 {
+		t.Errorf("%d counters kept, want 1", len(l.counters))
+	}
+}
@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Redis хранит записи в Redis или совместимом с ним сервере (KeyDB, Valkey и т.п.),
+// поэтому кэш и счетчики поколений общие для всех экземпляров сервиса. Используются только команды
+// GET, SET, MGET, INCR и PEXPIRE протокола RESP
+type Redis struct {
+	addr     string
+	password string
+	prefix   string
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+// Сброс кэша для многих пользователей (импорт, пересчет) отправляется несколькими пакетами,
+// чтобы каждый пакет успевал выполниться за время ожидания ответа
+const redisPipelineKeys = 500
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedis создает клиент, который держит не более poolSize открытых соединений без дела.
+// Все ключи записываются с префиксом prefix, чтобы сброс кэша не затрагивал чужие ключи
+func NewRedis(addr string, password string, prefix string, poolSize int) *Redis {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	return &Redis{
+		addr:     addr,
+		password: password,
+		prefix:   prefix,
+		timeout:  time.Second,
+		idle:     make(chan *redisConn, poolSize),
+	}
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.do(ctx, "GET", r.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return value, true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	// Redis не принимает нулевой срок жизни ключа
+	milliseconds := ttl.Milliseconds()
+	if milliseconds < 1 {
+		milliseconds = 1
+	}
+	_, err := r.do(ctx, "SET", r.prefix+key, string(value), "PX", strconv.FormatInt(milliseconds, 10))
+	return err
+}
+
+func (r *Redis) Counters(ctx context.Context, keys ...string) ([]int64, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, len(keys)+1)
+	args = append(args, "MGET")
+	for _, key := range keys {
+		args = append(args, r.prefix+key)
+	}
+	reply, err := r.do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items) != len(keys) {
+		return nil, fmt.Errorf("redis: unexpected reply to MGET: %v", reply)
+	}
+	values := make([]int64, 0, len(items))
+	for _, item := range items {
+		if item == nil {
+			values = append(values, 0)
+			continue
+		}
+		data, ok := item.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("redis: unexpected counter in MGET reply: %v", item)
+		}
+		value, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Incr отправляет INCR и PEXPIRE для счетчиков пакетами не больше redisPipelineKeys счетчиков
+func (r *Redis) Incr(ctx context.Context, ttl time.Duration, keys ...string) error {
+	milliseconds := strconv.FormatInt(ttl.Milliseconds(), 10)
+	for start := 0; start < len(keys); start += redisPipelineKeys {
+		end := start + redisPipelineKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		commands := make([][]string, 0, 2*(end-start))
+		for _, key := range keys[start:end] {
+			commands = append(commands,
+				[]string{"INCR", r.prefix + key},
+				[]string{"PEXPIRE", r.prefix + key, milliseconds},
+			)
+		}
+		_, err := r.pipeline(ctx, commands)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) do(ctx context.Context, args ...string) (any, error) {
+	replies, err := r.pipeline(ctx, [][]string{args})
+	if len(replies) == 0 {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+// Выполняет команды одним пакетом, соединение с ошибкой закрывается, а исправное возвращается в пул.
+// Ошибка в ответе на команду соединение не ломает и возвращается вместе с ответами
+func (r *Redis) pipeline(ctx context.Context, commands [][]string) ([]any, error) {
+	c, err := r.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(r.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+
+	replies, err := c.pipeline(commands)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+
+	for i, reply := range replies {
+		if replyErr, ok := reply.(redisError); ok {
+			replies[i] = nil
+			return replies, replyErr
+		}
+	}
+	return replies, nil
+}
+
+func (r *Redis) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: r.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if r.password != "" {
+		c.conn.SetDeadline(time.Now().Add(r.timeout))
+		_, err = c.command("AUTH", r.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) command(args ...string) (any, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := replies[0].(redisError); ok {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// Ошибки в ответах на отдельные команды возвращаются как значения redisError среди ответов
+func (c *redisConn) pipeline(commands [][]string) ([]any, error) {
+	writer := bufio.NewWriter(c.conn)
+	for _, args := range commands {
+		fmt.Fprintf(writer, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	err := writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, 0, len(commands))
+	for range commands {
+		reply, err := c.readReply()
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			replies = append(replies, replyErr)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// Ответ RESP: простая строка, ошибка, число, строка произвольной длины или массив
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := c.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				items = append(items, replyErr)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisServer разбирает команды RESP на стороне сервера net.Pipe и отвечает заранее заданными ответами
+type fakeRedisServer struct {
+	mu       sync.Mutex
+	commands [][]string
+	reply    func(args []string) string
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+
+		_, err = io.WriteString(conn, s.reply(args))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected array, got %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+// Клиент получает одно уже открытое соединение через пул, поэтому сеть не нужна
+func newTestRedis(t *testing.T, reply func(args []string) string) (*Redis, *fakeRedisServer) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	fake := &fakeRedisServer{reply: reply}
+	go fake.serve(server)
+
+	r := NewRedis("127.0.0.1:0", "", "test:", 1)
+	r.idle <- &redisConn{conn: client, reader: bufio.NewReader(client)}
+	return r, fake
+}
+
+func TestRedisGet(t *testing.T) {
+	ctx := context.Background()
+	r, fake := newTestRedis(t, func(args []string) string {
+		if args[1] == "test:hit" {
+			return "$5\r\nhello\r\n"
+		}
+		return "$-1\r\n"
+	})
+
+	value, ok, err := r.Get(ctx, "hit")
+	if err != nil || !ok || string(value) != "hello" {
+		t.Errorf("hit: got %q, %v, %v", value, ok, err)
+	}
+
+	value, ok, err = r.Get(ctx, "miss")
+	if err != nil || ok || value != nil {
+		t.Errorf("miss: got %q, %v, %v", value, ok, err)
+	}
+
+	want := [][]string{{"GET", "test:hit"}, {"GET", "test:miss"}}
+	if got := fake.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+}
+
+func TestRedisSet(t *testing.T) {
+	ctx := context.Background()
+	r, fake := newTestRedis(t, func(args []string) string {
+		return "+OK\r\n"
+	})
+
+	err := r.Set(ctx, "user:1", []byte(`[{"segment_slug":"A"}]`), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Нулевой срок жизни Redis не принимает, поэтому он округляется до миллисекунды
+	err = r.Set(ctx, "user:2", []byte("[]"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"SET", "test:user:1", `[{"segment_slug":"A"}]`, "PX", "1500"},
+		{"SET", "test:user:2", "[]", "PX", "1"},
+	}
+	if got := fake.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+}
+
+func TestRedisCounters(t *testing.T) {
+	ctx := context.Background()
+	r, fake := newTestRedis(t, func(args []string) string {
+		return "*2\r\n$1\r\n7\r\n$-1\r\n"
+	})
+
+	values, err := r.Counters(ctx, "gen", "gen:user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []int64{7, 0}) {
+		t.Errorf("counters = %v, want [7 0]", values)
+	}
+
+	want := [][]string{{"MGET", "test:gen", "test:gen:user:1"}}
+	if got := fake.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+}
+
+func TestRedisIncrPipelinesCommands(t *testing.T) {
+	ctx := context.Background()
+	r, fake := newTestRedis(t, func(args []string) string {
+		return ":1\r\n"
+	})
+
+	err := r.Incr(ctx, 2*time.Minute, "gen:user:1", "gen:user:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"INCR", "test:gen:user:1"},
+		{"PEXPIRE", "test:gen:user:1", "120000"},
+		{"INCR", "test:gen:user:2"},
+		{"PEXPIRE", "test:gen:user:2", "120000"},
+	}
+	if got := fake.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+}
+
+func TestRedisIncrReturnsReplyError(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, func(args []string) string {
+		if args[0] == "INCR" && args[1] == "test:bad" {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		return ":1\r\n"
+	})
+
+	err := r.Incr(ctx, time.Minute, "good", "bad")
+	var replyErr redisError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("expected reply error, got %v", err)
+	}
+
+	// Все ответы пакета прочитаны, поэтому соединение можно использовать дальше
+	err = r.Incr(ctx, time.Minute, "good")
+	if err != nil {
+		t.Errorf("second incr: %v", err)
+	}
+}
+
+func TestRedisErrorReplyKeepsConnection(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	r, _ := newTestRedis(t, func(args []string) string {
+		calls++
+		if calls == 1 {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		return "$1\r\nx\r\n"
+	})
+
+	_, _, err := r.Get(ctx, "k")
+	var replyErr redisError
+	if !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "WRONGTYPE") {
+		t.Fatalf("expected WRONGTYPE reply error, got %v", err)
+	}
+
+	// Ошибка в ответе не ломает соединение, оно возвращается в пул и используется повторно
+	value, ok, err := r.Get(ctx, "k")
+	if err != nil || !ok || string(value) != "x" {
+		t.Errorf("second get: got %q, %v, %v", value, ok, err)
+	}
+}
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  any
+		err   bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk string", "$3\r\nabc\r\n", []byte("abc"), false},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, false},
+		{"null bulk string", "$-1\r\n", nil, false},
+		{"null array", "*-1\r\n", nil, false},
+		{"nested array", "*2\r\n:1\r\n*1\r\n$1\r\na\r\n", []any{int64(1), []any{[]byte("a")}}, false},
+		{"error inside array", "*2\r\n-ERR bad\r\n:1\r\n", []any{redisError("ERR bad"), int64(1)}, false},
+		{"error", "-ERR bad\r\n", nil, true},
+		{"missing carriage return", "+OK\n", nil, true},
+		{"unknown type", "!3\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nab", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &redisConn{reader: bufio.NewReader(strings.NewReader(tt.input))}
+			got, err := c.readReply()
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
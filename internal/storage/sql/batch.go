@@ -0,0 +1,393 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+type membershipKey struct {
+	user int64
+	slug string
+}
+
+// historyBatch накапливает записи истории, чтобы вставить их одним запросом
+type historyBatch struct {
+	users   []int64
+	slugs   []string
+	actions []string
+}
+
+func (h *historyBatch) add(user int64, slug string, action models.Action) {
+	h.users = append(h.users, user)
+	h.slugs = append(h.slugs, slug)
+	h.actions = append(h.actions, string(action))
+}
+
+// UpdateSegmentsBatch применяет изменения сегментов для многих пользователей в одной транзакции.
+// Каждый шаг выполняется одним запросом для всего пакета, а не отдельным запросом на каждую строку.
+// В режиме partial операции, которые добавляют в несуществующие (в строгом режиме), архивные или составные сегменты,
+// не применяются и возвращаются с ошибкой, остальные операции применяются
+func (s *SQLStorage) UpdateSegmentsBatch(ctx context.Context, operations []models.BatchOperation, strict bool, partial bool) (_ []models.BatchItemResult, err error) {
+	defer func() { err = mapError(err) }()
+
+	results := make([]models.BatchItemResult, len(operations))
+	for i, operation := range operations {
+		results[i] = models.BatchItemResult{
+			User: operation.User,
+			UpdateResult: models.UpdateResult{
+				Added:      make([]models.Segment, 0),
+				TTLUpdated: make([]models.Segment, 0),
+				Removed:    make([]models.Segment, 0),
+				Ignored:    make([]models.Segment, 0),
+				Segments:   make([]models.Segment, 0),
+			},
+		}
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	addSlugs := batchAddSlugs(operations)
+
+	// В строгом режиме добавлять можно только в уже существующие сегменты, иначе создаем недостающие
+	unknown := make(map[string]bool)
+	if strict {
+		err = s.checkSegmentsExist(ctx, tx, slugsToSegments(addSlugs))
+		var unknownErr *storage.UnknownSegmentsError
+		if errors.As(err, &unknownErr) {
+			if !partial {
+				return nil, err
+			}
+			for _, slug := range unknownErr.Slugs {
+				unknown[slug] = true
+			}
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		query := `	INSERT INTO segments (slug)
+					SELECT unnest($1::text[])
+					ON CONFLICT (slug) DO NOTHING`
+		_, err = tx.Exec(ctx, query, addSlugs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	archived, composite, err := s.lockBatchSegments(ctx, tx, addSlugs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Определяем операции, которые нельзя применить
+	for i, operation := range operations {
+		for _, segment := range operation.Add {
+			if unknown[segment.Slug] {
+				results[i].Err = &storage.UnknownSegmentsError{Slugs: operationAddSlugs(operation, unknown)}
+				break
+			}
+			if archived[segment.Slug] {
+				results[i].Err = fmt.Errorf("%w: %s", storage.ErrSegmentArchived, segment.Slug)
+				break
+			}
+			if composite[segment.Slug] {
+				results[i].Err = &storage.CompositeSegmentsError{Slugs: operationAddSlugs(operation, composite)}
+				break
+			}
+		}
+		if results[i].Err != nil && !partial {
+			return nil, results[i].Err
+		}
+	}
+
+	var (
+		users        []int64
+		delUsers     []int64
+		delSlugs     []string
+		addUsers     []int64
+		addPairSlugs []string
+	)
+	for i, operation := range operations {
+		if results[i].Err != nil {
+			continue
+		}
+		users = append(users, operation.User)
+		for _, segment := range operation.Delete {
+			delUsers = append(delUsers, operation.User)
+			delSlugs = append(delSlugs, segment.Slug)
+		}
+		for _, segment := range operation.Add {
+			addUsers = append(addUsers, operation.User)
+			addPairSlugs = append(addPairSlugs, segment.Slug)
+		}
+	}
+
+	// Добавляем пользователей, которых еще не существует
+	query := `	INSERT INTO users (id)
+				SELECT unnest($1::bigint[])
+				ON CONFLICT (id) DO NOTHING`
+	_, err = tx.Exec(ctx, query, users)
+	if err != nil {
+		return nil, err
+	}
+
+	var history historyBatch
+
+	// Удаляем пользователей из сегментов одним запросом, в ответ попадают только действительно удаленные строки
+	removed, err := s.deleteBatchMemberships(ctx, tx, delUsers, delSlugs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, operation := range operations {
+		if results[i].Err != nil {
+			continue
+		}
+		for _, segment := range operation.Delete {
+			key := membershipKey{operation.User, segment.Slug}
+			if !removed[key] {
+				results[i].Ignored = append(results[i].Ignored, models.Segment{Slug: segment.Slug})
+				continue
+			}
+			delete(removed, key)
+			history.add(operation.User, segment.Slug, models.ActionRemove)
+			results[i].Removed = append(results[i].Removed, models.Segment{Slug: segment.Slug})
+		}
+	}
+
+	// Блокируем существующие строки членства в сегментах из списков на добавление и узнаем их состояние
+	existing, err := s.lockBatchMemberships(ctx, tx, addUsers, addPairSlugs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		upsertUsers []int64
+		upsertSlugs []string
+		upsertTTLs  []int64
+	)
+	for i, operation := range operations {
+		if results[i].Err != nil {
+			continue
+		}
+		for _, segment := range dedupeSegments(operation.Add) {
+			membership := existing[membershipKey{operation.User, segment.Slug}]
+
+			// Пользователь уже в сегменте без TTL и TTL не передан - ничего не меняется, в историю не пишем
+			if membership.exists && !membership.expired && membership.expiresAt == nil && segment.DaysTTL == 0 {
+				continue
+			}
+
+			// Если сегмент уже истек, но еще не был удален фоновой задачей, то фиксируем удаление по TTL
+			if membership.expired {
+				history.add(operation.User, segment.Slug, models.ActionRemove)
+			}
+
+			upsertUsers = append(upsertUsers, operation.User)
+			upsertSlugs = append(upsertSlugs, segment.Slug)
+			upsertTTLs = append(upsertTTLs, int64(segment.DaysTTL))
+
+			if membership.exists && !membership.expired {
+				history.add(operation.User, segment.Slug, models.ActionTTLUpdate)
+				results[i].TTLUpdated = append(results[i].TTLUpdated, segment)
+				continue
+			}
+			history.add(operation.User, segment.Slug, models.ActionAdd)
+			results[i].Added = append(results[i].Added, segment)
+		}
+	}
+
+	query = `	INSERT INTO users_segments (user_id, segment_slug, expires_at)
+				SELECT user_id, slug, CASE WHEN ttl = 0 THEN null ELSE now() + interval '1 day' * ttl END
+				FROM unnest($1::bigint[], $2::text[], $3::integer[]) AS t(user_id, slug, ttl)
+				ON CONFLICT (user_id, segment_slug) DO UPDATE
+				SET expires_at = EXCLUDED.expires_at,
+					joined_at = CASE WHEN users_segments.expires_at < now() THEN now() ELSE users_segments.joined_at END,
+					reason = NULL`
+	_, err = tx.Exec(ctx, query, upsertUsers, upsertSlugs, upsertTTLs)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, slug, action, now()
+				FROM unnest($1::bigint[], $2::text[], $3::text[]) AS t(user_id, slug, action)`
+	_, err = tx.Exec(ctx, query, history.users, history.slugs, history.actions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Получаем итоговые списки сегментов всех пользователей пакета внутри той же транзакции
+	segments, err := s.getUsersSegments(ctx, tx, users)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		results[i].Applied = true
+		if userSegments, ok := segments[results[i].User]; ok {
+			results[i].Segments = userSegments
+		}
+	}
+
+	return results, tx.Commit(ctx)
+}
+
+// Уникальные названия сегментов из всех списков на добавление, отсортированные для одинакового порядка блокировок
+func batchAddSlugs(operations []models.BatchOperation) []string {
+	seen := make(map[string]bool)
+	slugs := make([]string, 0)
+	for _, operation := range operations {
+		for _, segment := range operation.Add {
+			if !seen[segment.Slug] {
+				seen[segment.Slug] = true
+				slugs = append(slugs, segment.Slug)
+			}
+		}
+	}
+	sort.Strings(slugs)
+	return slugs
+}
+
+func slugsToSegments(slugs []string) []models.Segment {
+	segments := make([]models.Segment, 0, len(slugs))
+	for _, slug := range slugs {
+		segments = append(segments, models.Segment{Slug: slug})
+	}
+	return segments
+}
+
+// Сегменты из списка операции на добавление, которые входят в множество slugs
+func operationAddSlugs(operation models.BatchOperation, set map[string]bool) []string {
+	slugs := make([]string, 0)
+	for _, segment := range operation.Add {
+		if set[segment.Slug] {
+			slugs = append(slugs, segment.Slug)
+		}
+	}
+	return slugs
+}
+
+// Если сегмент встречается в списке на добавление несколько раз, то применяется последнее значение TTL
+func dedupeSegments(segments []models.Segment) []models.Segment {
+	last := make(map[string]int, len(segments))
+	for i, segment := range segments {
+		last[segment.Slug] = i
+	}
+
+	unique := make([]models.Segment, 0, len(last))
+	for i, segment := range segments {
+		if last[segment.Slug] == i {
+			unique = append(unique, segment)
+		}
+	}
+	return unique
+}
+
+// Блокируем сегменты пакета от архивирования и изменения состава до конца транзакции
+// и возвращаем те, что уже в архиве, и составные
+func (s *SQLStorage) lockBatchSegments(ctx context.Context, tx pgx.Tx, slugs []string) (map[string]bool, map[string]bool, error) {
+
+	archived := make(map[string]bool)
+	composite := make(map[string]bool)
+
+	query := `	SELECT slug, deleted_at IS NOT NULL, composite_op IS NOT NULL FROM segments
+				WHERE slug = ANY($1)
+				ORDER BY slug
+				FOR SHARE`
+	rows, err := tx.Query(ctx, query, slugs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			slug        string
+			isArchived  bool
+			isComposite bool
+		)
+		err = rows.Scan(&slug, &isArchived, &isComposite)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isArchived {
+			archived[slug] = true
+		}
+		if isComposite {
+			composite[slug] = true
+		}
+	}
+	return archived, composite, rows.Err()
+}
+
+func (s *SQLStorage) deleteBatchMemberships(ctx context.Context, tx pgx.Tx, users []int64, slugs []string) (map[membershipKey]bool, error) {
+
+	memberships := make(map[membershipKey]bool)
+
+	query := `	DELETE FROM users_segments us
+				USING unnest($1::bigint[], $2::text[]) AS t(user_id, slug)
+				WHERE us.user_id = t.user_id AND us.segment_slug = t.slug
+				RETURNING us.user_id, us.segment_slug`
+	rows, err := tx.Query(ctx, query, users, slugs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key membershipKey
+		err = rows.Scan(&key.user, &key.slug)
+		if err != nil {
+			return nil, err
+		}
+		memberships[key] = true
+	}
+	return memberships, rows.Err()
+}
+
+// То же, что lockMembership, но для всех пар пользователь-сегмент пакета одним запросом
+func (s *SQLStorage) lockBatchMemberships(ctx context.Context, tx pgx.Tx, users []int64, slugs []string) (map[membershipKey]membership, error) {
+
+	memberships := make(map[membershipKey]membership)
+
+	query := `	SELECT us.user_id, us.segment_slug, us.expires_at, coalesce(us.expires_at < now(), false)
+				FROM users_segments us
+				JOIN unnest($1::bigint[], $2::text[]) AS t(user_id, slug)
+				ON us.user_id = t.user_id AND us.segment_slug = t.slug
+				ORDER BY us.user_id, us.segment_slug
+				FOR UPDATE OF us`
+	rows, err := tx.Query(ctx, query, users, slugs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key membershipKey
+			m   membership
+		)
+		err = rows.Scan(&key.user, &key.slug, &m.expiresAt, &m.expired)
+		if err != nil {
+			return nil, err
+		}
+		m.exists = true
+		memberships[key] = m
+	}
+	return memberships, rows.Err()
+}
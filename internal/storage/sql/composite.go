@@ -0,0 +1,252 @@
+package sql
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// Изменения состава сегментов выполняются по одной, иначе две транзакции могли бы одновременно
+// добавить сегменты в составы друг друга и каждая не увидела бы цикл
+const compositionLockKey = 7351244932
+
+type compositeSegment struct {
+	operation models.SetOperation
+	segments  []string
+}
+
+// Активные составные сегменты по названию
+func getCompositeSegments(ctx context.Context, q querier) (map[string]compositeSegment, error) {
+
+	composites := make(map[string]compositeSegment)
+
+	query := `SELECT slug, composite_op, composite_of FROM segments WHERE composite_op IS NOT NULL AND deleted_at IS NULL`
+	rows, err := q.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			slug      string
+			operation string
+			composite compositeSegment
+		)
+		err = rows.Scan(&slug, &operation, &composite.segments)
+		if err != nil {
+			return nil, err
+		}
+		composite.operation = models.SetOperation(operation)
+		composites[slug] = composite
+	}
+	return composites, rows.Err()
+}
+
+// Добавляем к сегментам пользователей составные сегменты, которые получаются из их сегментов.
+// Составной сегмент может входить в состав другого, архивные и удаленные сегменты в составе считаются пустыми.
+// Членство в составном сегменте только вычисляется, хранимые строки по нему отбрасываются.
+// Итоговые списки упорядочены по названию сегмента
+func addCompositeSegments(ctx context.Context, q querier, segments map[int64][]models.Segment) (map[int64][]models.Segment, error) {
+
+	composites, err := getCompositeSegments(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(composites) == 0 {
+		return segments, nil
+	}
+
+	for user, userSegments := range segments {
+		member := make(map[string]bool, len(userSegments))
+		result := make([]models.Segment, 0, len(userSegments))
+		for _, segment := range userSegments {
+			if _, ok := composites[segment.Slug]; ok {
+				continue
+			}
+			member[segment.Slug] = true
+			result = append(result, segment)
+		}
+		stored := len(result)
+
+		resolved := make(map[string]bool, len(composites))
+		for slug := range composites {
+			if resolveComposite(slug, composites, member, resolved) {
+				result = append(result, models.Segment{Slug: slug})
+			}
+		}
+
+		if len(result) != stored {
+			sort.Slice(result, func(i, j int) bool {
+				return result[i].Slug < result[j].Slug
+			})
+		}
+		segments[user] = result
+	}
+	return segments, nil
+}
+
+// Вычисляем членство в сегменте, запоминая уже вычисленные составные сегменты. Циклы не допускаются
+// при изменении состава, но сегмент, который уже вычисляется, на всякий случай считается пустым
+func resolveComposite(slug string, composites map[string]compositeSegment, member map[string]bool, resolved map[string]bool) bool {
+
+	composite, ok := composites[slug]
+	if !ok {
+		return member[slug]
+	}
+	if result, ok := resolved[slug]; ok {
+		return result
+	}
+	resolved[slug] = false
+
+	var result bool
+	switch composite.operation {
+	case models.SetUnion:
+		for _, operand := range composite.segments {
+			if resolveComposite(operand, composites, member, resolved) {
+				result = true
+				break
+			}
+		}
+	case models.SetIntersect:
+		result = true
+		for _, operand := range composite.segments {
+			if !resolveComposite(operand, composites, member, resolved) {
+				result = false
+				break
+			}
+		}
+	case models.SetDifference:
+		result = resolveComposite(composite.segments[0], composites, member, resolved)
+		for _, operand := range composite.segments[1:] {
+			if !result {
+				break
+			}
+			result = !resolveComposite(operand, composites, member, resolved)
+		}
+	}
+	resolved[slug] = result
+	return result
+}
+
+func containsSegment(segments []models.Segment, slug string) bool {
+	for _, segment := range segments {
+		if segment.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// Членство в составном сегменте вычисляется, поэтому при назначении сегменту состава
+// добавленные раньше пользователи удаляются из него с записью в историю
+func removeCompositeMembers(ctx context.Context, tx pgx.Tx, slug string) error {
+
+	query := `	WITH removed AS (
+					DELETE FROM users_segments
+					WHERE segment_slug = $1
+					RETURNING user_id, segment_slug
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, segment_slug, $2, now() FROM removed`
+	_, err := tx.Exec(ctx, query, slug, string(models.ActionRemove))
+	return err
+}
+
+// Проверяем новый состав сегмента: все сегменты состава должны существовать, а сегмент не должен
+// прямо или через другие составные сегменты входить в собственный состав. Состав уже записан в транзакции
+func checkComposition(ctx context.Context, tx pgx.Tx, slug string, composition []string) error {
+
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, compositionLockKey)
+	if err != nil {
+		return err
+	}
+
+	query := `	SELECT requested.slug FROM unnest($1::text[]) AS requested(slug)
+				WHERE NOT EXISTS (SELECT 1 FROM segments s WHERE s.slug = requested.slug)`
+	rows, err := tx.Query(ctx, query, composition)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	unknown := make([]string, 0)
+	for rows.Next() {
+		var unknownSlug string
+		err = rows.Scan(&unknownSlug)
+		if err != nil {
+			return err
+		}
+		unknown = append(unknown, unknownSlug)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	if len(unknown) != 0 {
+		return &storage.UnknownSegmentsError{Slugs: unknown}
+	}
+
+	// Граф составов строится и по архивным сегментам, так как их можно восстановить
+	graph := make(map[string][]string)
+	query = `SELECT slug, composite_of FROM segments WHERE composite_op IS NOT NULL`
+	rows, err = tx.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			composite string
+			operands  []string
+		)
+		err = rows.Scan(&composite, &operands)
+		if err != nil {
+			return err
+		}
+		graph[composite] = operands
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	path := findCycle(graph, slug, slug, []string{slug}, make(map[string]bool))
+	if path != nil {
+		return &storage.CompositionCycleError{Cycle: path}
+	}
+	return nil
+}
+
+// Поиск в глубину пути от сегмента from обратно к target, возвращает путь вместе с target на обоих концах
+func findCycle(graph map[string][]string, from string, target string, path []string, visited map[string]bool) []string {
+
+	for _, operand := range graph[from] {
+		if operand == target {
+			return append(path, operand)
+		}
+		if visited[operand] {
+			continue
+		}
+		visited[operand] = true
+
+		cycle := findCycle(graph, operand, target, append(path, operand), visited)
+		if cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Параметры состава для запросов, у сегмента без состава операция и список сегментов равны NULL
+func compositionOrNull(composition *models.Composition) (any, any) {
+	if composition == nil || composition.Operation == "" {
+		return nil, nil
+	}
+	return string(composition.Operation), composition.Segments
+}
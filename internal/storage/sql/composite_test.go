@@ -0,0 +1,243 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+)
+
+// compositeRows отдает строки составных сегментов так, как их возвращает запрос getCompositeSegments
+type compositeRows struct {
+	slugs      []string
+	composites map[string]compositeSegment
+	pos        int
+}
+
+func (r *compositeRows) Close()                                       {}
+func (r *compositeRows) Err() error                                   { return nil }
+func (r *compositeRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *compositeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *compositeRows) Values() ([]any, error)                       { return nil, nil }
+func (r *compositeRows) RawValues() [][]byte                          { return nil }
+func (r *compositeRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *compositeRows) Next() bool {
+	r.pos++
+	return r.pos <= len(r.slugs)
+}
+
+func (r *compositeRows) Scan(dest ...any) error {
+	slug := r.slugs[r.pos-1]
+	composite := r.composites[slug]
+	*dest[0].(*string) = slug
+	*dest[1].(*string) = string(composite.operation)
+	*dest[2].(*[]string) = composite.segments
+	return nil
+}
+
+type compositeQuerier map[string]compositeSegment
+
+func (q compositeQuerier) Query(_ context.Context, query string, _ ...any) (pgx.Rows, error) {
+	if !strings.Contains(query, "composite_op IS NOT NULL") {
+		return nil, fmt.Errorf("unexpected query %s", query)
+	}
+	rows := &compositeRows{composites: q}
+	for slug := range q {
+		rows.slugs = append(rows.slugs, slug)
+	}
+	return rows, nil
+}
+
+func composite(operation models.SetOperation, segments ...string) compositeSegment {
+	return compositeSegment{operation: operation, segments: segments}
+}
+
+func TestResolveComposite(t *testing.T) {
+	composites := map[string]compositeSegment{
+		"UNION":         composite(models.SetUnion, "A", "B"),
+		"INTERSECT":     composite(models.SetIntersect, "A", "B", "C"),
+		"DIFFERENCE":    composite(models.SetDifference, "A", "B", "C"),
+		"NESTED":        composite(models.SetIntersect, "UNION", "D"),
+		"NESTED_DIFF":   composite(models.SetDifference, "UNION", "INTERSECT"),
+		"EMPTY_OPERAND": composite(models.SetUnion, "ARCHIVED", "MISSING"),
+	}
+
+	tests := []struct {
+		slug    string
+		members []string
+		want    bool
+	}{
+		{"UNION", []string{"A"}, true},
+		{"UNION", []string{"B"}, true},
+		{"UNION", []string{"C"}, false},
+		{"UNION", nil, false},
+
+		{"INTERSECT", []string{"A", "B", "C"}, true},
+		{"INTERSECT", []string{"A", "B"}, false},
+
+		{"DIFFERENCE", []string{"A"}, true},
+		{"DIFFERENCE", []string{"A", "B"}, false},
+		{"DIFFERENCE", []string{"A", "C"}, false},
+		{"DIFFERENCE", []string{"B"}, false},
+
+		{"NESTED", []string{"B", "D"}, true},
+		{"NESTED", []string{"B"}, false},
+		{"NESTED", []string{"D"}, false},
+		{"NESTED_DIFF", []string{"A"}, true},
+		{"NESTED_DIFF", []string{"A", "B", "C"}, false},
+
+		// Архивные и удаленные сегменты не попадают в хранимое членство и считаются пустыми
+		{"EMPTY_OPERAND", []string{"A"}, false},
+
+		// Обычный сегмент вычисляется по хранимому членству
+		{"A", []string{"A"}, true},
+		{"A", nil, false},
+
+		// Хранимая строка по составному сегменту не меняет результат операции
+		{"UNION", []string{"UNION"}, false},
+		{"DIFFERENCE", []string{"DIFFERENCE", "A", "B"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.slug, tt.members), func(t *testing.T) {
+			member := make(map[string]bool)
+			for _, slug := range tt.members {
+				member[slug] = true
+			}
+			got := resolveComposite(tt.slug, composites, member, make(map[string]bool))
+			if got != tt.want {
+				t.Errorf("resolveComposite(%s) = %v, want %v", tt.slug, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCompositeCycle(t *testing.T) {
+	// Циклы не допускаются при изменении состава, но вычисление не должно зацикливаться на старых данных
+	composites := map[string]compositeSegment{
+		"X": composite(models.SetUnion, "Y", "A"),
+		"Y": composite(models.SetUnion, "X", "B"),
+		"Z": composite(models.SetUnion, "Z", "A"),
+	}
+
+	tests := []struct {
+		slug    string
+		members []string
+		want    bool
+	}{
+		{"X", []string{"A"}, true},
+		{"X", []string{"B"}, true},
+		{"X", nil, false},
+		{"Z", []string{"A"}, true},
+		{"Z", nil, false},
+	}
+
+	for _, tt := range tests {
+		member := make(map[string]bool)
+		for _, slug := range tt.members {
+			member[slug] = true
+		}
+		if got := resolveComposite(tt.slug, composites, member, make(map[string]bool)); got != tt.want {
+			t.Errorf("resolveComposite(%s) with %v = %v, want %v", tt.slug, tt.members, got, tt.want)
+		}
+	}
+}
+
+func TestAddCompositeSegments(t *testing.T) {
+	q := compositeQuerier{
+		"AB":      composite(models.SetUnion, "A", "B"),
+		"A_NOT_B": composite(models.SetDifference, "A", "B"),
+		"BOTH":    composite(models.SetIntersect, "AB", "C"),
+	}
+
+	segments := map[int64][]models.Segment{
+		1: {{Slug: "A"}, {Slug: "C"}},
+		2: {{Slug: "A"}, {Slug: "B"}},
+		3: {{Slug: "D"}},
+		// Хранимая строка по составному сегменту отбрасывается, членство вычисляется по составу
+		4: {{Slug: "AB"}, {Slug: "D"}},
+		5: {{Slug: "A_NOT_B"}, {Slug: "B"}},
+		6: {},
+	}
+
+	got, err := addCompositeSegments(context.Background(), q, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int64][]string{
+		1: {"A", "AB", "A_NOT_B", "BOTH", "C"},
+		2: {"A", "AB", "B"},
+		3: {"D"},
+		4: {"D"},
+		5: {"AB", "B"},
+		6: {},
+	}
+	for user, slugs := range want {
+		gotSlugs := make([]string, 0)
+		for _, segment := range got[user] {
+			gotSlugs = append(gotSlugs, segment.Slug)
+		}
+		if !reflect.DeepEqual(gotSlugs, slugs) {
+			t.Errorf("user %d: got %v, want %v", user, gotSlugs, slugs)
+		}
+	}
+}
+
+func TestAddCompositeSegmentsKeepsStoredSegments(t *testing.T) {
+	segments := map[int64][]models.Segment{
+		1: {{Slug: "A", DaysTTL: 3}, {Slug: "B"}},
+	}
+
+	// Без составных сегментов списки не меняются
+	got, err := addCompositeSegments(context.Background(), compositeQuerier{}, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, segments) {
+		t.Errorf("got %v, want %v", got, segments)
+	}
+
+	// Хранимые сегменты сохраняют свои поля
+	got, err = addCompositeSegments(context.Background(), compositeQuerier{"AB": composite(models.SetUnion, "A", "B")}, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.Segment{{Slug: "A", DaysTTL: 3}, {Slug: "AB"}, {Slug: "B"}}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Errorf("got %v, want %v", got[1], want)
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph map[string][]string
+		slug  string
+		want  []string
+	}{
+		{"no cycle", map[string][]string{"X": {"A", "B"}, "Y": {"X", "C"}}, "Y", nil},
+		{"self reference", map[string][]string{"X": {"A", "X"}}, "X", []string{"X", "X"}},
+		{"direct cycle", map[string][]string{"X": {"Y"}, "Y": {"X"}}, "X", []string{"X", "Y", "X"}},
+		{"indirect cycle", map[string][]string{"X": {"A", "Y"}, "Y": {"B", "Z"}, "Z": {"X"}}, "X", []string{"X", "Y", "Z", "X"}},
+		// Цикл, который не проходит через изменяемый сегмент, к нему не относится
+		{"cycle elsewhere", map[string][]string{"X": {"Y"}, "Y": {"Z"}, "Z": {"Y"}}, "X", nil},
+		{"diamond without cycle", map[string][]string{"X": {"Y", "Z"}, "Y": {"W"}, "Z": {"W"}, "W": {"A"}}, "X", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findCycle(tt.graph, tt.slug, tt.slug, []string{tt.slug}, make(map[string]bool))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findCycle = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// mapError переводит ошибки PostgreSQL в общие ошибки хранилища по классу SQLSTATE
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		// unique_violation, foreign_key_violation, serialization_failure, deadlock_detected
+		case "23505", "23503", "40001", "40P01":
+			return &storage.Error{Kind: storage.ErrConflict, Err: err}
+		// not_null_violation, check_violation, string_data_right_truncation, numeric_value_out_of_range
+		case "23502", "23514", "22001", "22003":
+			return &storage.Error{Kind: storage.ErrInvalidData, Err: err}
+		// query_canceled, admin_shutdown, crash_shutdown, cannot_connect_now, too_many_connections
+		case "57014", "57P01", "57P02", "57P03", "53300":
+			return &storage.Error{Kind: storage.ErrUnavailable, Err: err}
+		}
+		// connection_exception
+		if len(pgErr.Code) == 5 && pgErr.Code[:2] == "08" {
+			return &storage.Error{Kind: storage.ErrUnavailable, Err: err}
+		}
+		return err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return &storage.Error{Kind: storage.ErrUnavailable, Err: err}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &storage.Error{Kind: storage.ErrUnavailable, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,333 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// Строки файла загружаются и применяются частями, после каждой части обновляется прогресс задачи
+const importChunkSize = 10000
+
+// Задача выполняется в памяти процесса, который ее принял, и пока она выполняется, процесс обновляет heartbeat_at.
+// Задачи, heartbeat_at которых давно не обновлялся, принадлежат остановленному процессу и помечаются ошибочными.
+// Остальные реплики сервиса при этом продолжают свои задачи
+const (
+	importHeartbeatInterval = 30 * time.Second
+	importStaleAfter        = 5 * time.Minute
+)
+
+const importJobColumns = `id, segment_slug, mode, status, total_rows, processed_rows, changed_rows, error, created_at, updated_at`
+
+func (s *SQLStorage) CreateImportJob(ctx context.Context, slug string, mode models.ImportMode, totalRows int) (_ models.ImportJob, err error) {
+	defer func() { err = mapError(err) }()
+
+	var job models.ImportJob
+
+	// Добавлять пользователей можно только в активный сегмент без состава, удалять - и из архивного
+	var archived, composite bool
+	query := `SELECT deleted_at IS NOT NULL, composite_op IS NOT NULL FROM segments WHERE slug = $1`
+	err = s.pool.QueryRow(ctx, query, slug).Scan(&archived, &composite)
+	if err == pgx.ErrNoRows {
+		return job, storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return job, err
+	}
+	if archived && mode == models.ImportAdd {
+		return job, fmt.Errorf("%w: %s", storage.ErrSegmentArchived, slug)
+	}
+	if composite && mode == models.ImportAdd {
+		return job, &storage.CompositeSegmentsError{Slugs: []string{slug}}
+	}
+
+	query = `	INSERT INTO import_jobs (segment_slug, mode, status, total_rows)
+				VALUES ($1, $2, $3, $4)
+				RETURNING ` + importJobColumns
+	row := s.pool.QueryRow(ctx, query, slug, string(mode), string(models.ImportPending), totalRows)
+	return scanImportJob(row)
+}
+
+func (s *SQLStorage) GetImportJob(ctx context.Context, slug string, id int64) (_ models.ImportJob, err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `SELECT ` + importJobColumns + ` FROM import_jobs WHERE id = $1 AND segment_slug = $2`
+	job, err := scanImportJob(s.pool.QueryRow(ctx, query, id, slug))
+	if err == pgx.ErrNoRows {
+		return job, storage.ErrImportNotFound
+	}
+	return job, err
+}
+
+// RunImportJob выполняется в фоне после ответа клиенту, поэтому ошибки не возвращает, а сохраняет в задаче.
+// Каждая часть файла применяется в отдельной транзакции, поэтому при ошибке уже примененные части остаются
+func (s *SQLStorage) RunImportJob(job models.ImportJob, rows []models.ImportRow) {
+
+	ctx := context.Background()
+
+	err := s.setImportJobStatus(ctx, job.ID, models.ImportRunning, "")
+	if err != nil {
+		s.logger.Errorw("error",
+			"RunImportJob: updating import_jobs failed ", err,
+		)
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.importHeartbeat(job.ID, stop)
+
+	for start := 0; start < len(rows); start += importChunkSize {
+		end := start + importChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		err = s.importChunk(ctx, job, rows[start:end])
+		if err != nil {
+			err = mapError(err)
+			s.logger.Errorw("error",
+				"RunImportJob: importing rows failed ", err,
+			)
+
+			err = s.setImportJobStatus(ctx, job.ID, models.ImportFailed, err.Error())
+			if err != nil {
+				s.logger.Errorw("error",
+					"RunImportJob: updating import_jobs failed ", err,
+				)
+			}
+			return
+		}
+	}
+
+	err = s.setImportJobStatus(ctx, job.ID, models.ImportDone, "")
+	if err != nil {
+		s.logger.Errorw("error",
+			"RunImportJob: updating import_jobs failed ", err,
+		)
+		return
+	}
+	s.logger.Infow("info",
+		"RunImportJob: successfully imported rows: ", len(rows),
+	)
+}
+
+func (s *SQLStorage) setImportJobStatus(ctx context.Context, id int64, status models.ImportStatus, message string) error {
+
+	query := `	UPDATE import_jobs SET status = $2, error = $3, updated_at = now(), heartbeat_at = now()
+				WHERE id = $1`
+	_, err := s.pool.Exec(ctx, query, id, string(status), message)
+	return err
+}
+
+// importHeartbeat отмечает, что задача еще выполняется, пока не закрыт канал stop
+func (s *SQLStorage) importHeartbeat(id int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(importHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			query := `UPDATE import_jobs SET heartbeat_at = now() WHERE id = $1`
+			_, err := s.pool.Exec(context.Background(), query, id)
+			if err != nil {
+				s.logger.Errorw("error",
+					"importHeartbeat: updating import_jobs failed ", err,
+				)
+			}
+		}
+	}
+}
+
+// FailStaleImportJobs помечает ошибочными незавершенные задачи, процесс которых был остановлен
+func (s *SQLStorage) FailStaleImportJobs() {
+
+	failed, err := s.failStaleImportJobs(context.Background())
+	if err != nil {
+		s.logger.Errorw("error",
+			"FailStaleImportJobs: updating import_jobs failed ", err,
+		)
+		return
+	}
+
+	s.logger.Infow("info",
+		"FailStaleImportJobs: successfully failed stale jobs: ", failed,
+	)
+}
+
+func (s *SQLStorage) failStaleImportJobs(ctx context.Context) (int64, error) {
+
+	query := `	UPDATE import_jobs SET status = 'failed', error = 'interrupted by service restart', updated_at = now()
+				WHERE status IN ('pending', 'running') AND heartbeat_at < now() - $1 * interval '1 second'`
+	res, err := s.pool.Exec(ctx, query, importStaleAfter.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+// Часть файла загружается через COPY во временную таблицу, а затем применяется к сегменту несколькими запросами
+func (s *SQLStorage) importChunk(ctx context.Context, job models.ImportJob, rows []models.ImportRow) error {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокируем сегмент от архивирования, переименования и изменения состава до конца транзакции
+	var archived, composite bool
+	query := `SELECT deleted_at IS NOT NULL, composite_op IS NOT NULL FROM segments WHERE slug = $1 FOR SHARE`
+	err = tx.QueryRow(ctx, query, job.Slug).Scan(&archived, &composite)
+	if err == pgx.ErrNoRows {
+		return storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived && job.Mode == models.ImportAdd {
+		return fmt.Errorf("%w: %s", storage.ErrSegmentArchived, job.Slug)
+	}
+	if composite && job.Mode == models.ImportAdd {
+		return &storage.CompositeSegmentsError{Slugs: []string{job.Slug}}
+	}
+
+	query = `CREATE TEMP TABLE import_staging (line integer, user_id bigint, days_ttl integer) ON COMMIT DROP`
+	_, err = tx.Exec(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"import_staging"}, []string{"line", "user_id", "days_ttl"},
+		pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			return []any{rows[i].Line, rows[i].User, rows[i].DaysTTL}, nil
+		}))
+	if err != nil {
+		return err
+	}
+
+	var changed int64
+	switch job.Mode {
+	case models.ImportAdd:
+		changed, err = mergeImportAdd(ctx, tx, job.Slug)
+	case models.ImportRemove:
+		changed, err = mergeImportRemove(ctx, tx, job.Slug)
+	default:
+		err = fmt.Errorf("%w: unknown import mode %s", storage.ErrInvalidData, job.Mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	query = `	UPDATE import_jobs
+				SET processed_rows = processed_rows + $2, changed_rows = changed_rows + $3, updated_at = now(), heartbeat_at = now()
+				WHERE id = $1`
+	_, err = tx.Exec(ctx, query, job.ID, len(rows), changed)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Добавляем пользователей из временной таблицы в сегмент и пишем историю так же, как UpdateSegmentsByUserID:
+// истекший сегмент фиксируется удалением и повторным добавлением, для состоящих в сегменте пользователей
+// обновляется TTL, если пользователь уже в сегменте без TTL и TTL не передан, то ничего не меняется
+func mergeImportAdd(ctx context.Context, tx pgx.Tx, slug string) (int64, error) {
+
+	query := `	INSERT INTO users (id)
+				SELECT DISTINCT user_id FROM import_staging
+				ON CONFLICT (id) DO NOTHING`
+	_, err := tx.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	// Блокируем существующие строки членства до конца транзакции
+	query = `	SELECT 1 FROM users_segments
+				WHERE segment_slug = $1::text AND user_id IN (SELECT user_id FROM import_staging)
+				ORDER BY user_id
+				FOR UPDATE`
+	_, err = tx.Exec(ctx, query, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	// Если пользователь встречается в файле несколько раз, то применяется последняя строка
+	query = `	WITH staged AS (
+					SELECT DISTINCT ON (user_id) user_id, days_ttl FROM import_staging
+					ORDER BY user_id, line DESC
+				), existing AS (
+					SELECT st.user_id, st.days_ttl,
+						us.user_id IS NOT NULL AS present,
+						coalesce(us.expires_at < now(), false) AS expired,
+						us.expires_at IS NULL AS permanent
+					FROM staged st
+					LEFT JOIN users_segments us ON us.user_id = st.user_id AND us.segment_slug = $1::text
+				), changes AS (
+					SELECT * FROM existing
+					WHERE NOT (present AND NOT expired AND permanent AND days_ttl = 0)
+				), upserted AS (
+					INSERT INTO users_segments (user_id, segment_slug, expires_at)
+					SELECT user_id, $1::text, CASE WHEN days_ttl = 0 THEN null ELSE now() + interval '1 day' * days_ttl END
+					FROM changes
+					ON CONFLICT (user_id, segment_slug) DO UPDATE
+					SET expires_at = EXCLUDED.expires_at,
+						joined_at = CASE WHEN users_segments.expires_at < now() THEN now() ELSE users_segments.joined_at END,
+						reason = NULL
+				), expired_history AS (
+					INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+					SELECT user_id, $1::text, $2::text, now() FROM changes
+					WHERE expired
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, $1::text, CASE WHEN present AND NOT expired THEN $3::text ELSE $4::text END, now()
+				FROM changes`
+	tag, err := tx.Exec(ctx, query, slug, string(models.ActionRemove), string(models.ActionTTLUpdate), string(models.ActionAdd))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Удаляем пользователей из временной таблицы из сегмента, в историю попадают только действительно удаленные.
+// Истекшее, но еще не очищенное членство не трогаем: пользователь уже не в сегменте,
+// а удаление по TTL запишет в историю фоновая очистка
+func mergeImportRemove(ctx context.Context, tx pgx.Tx, slug string) (int64, error) {
+
+	query := `	WITH removed AS (
+					DELETE FROM users_segments us
+					USING import_staging st
+					WHERE us.segment_slug = $1::text AND us.user_id = st.user_id
+						AND (us.expires_at >= now() OR us.expires_at IS NULL)
+					RETURNING us.user_id
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, $1::text, $2::text, now() FROM removed`
+	tag, err := tx.Exec(ctx, query, slug, string(models.ActionRemove))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanImportJob(row rowScanner) (models.ImportJob, error) {
+	var (
+		job    models.ImportJob
+		mode   string
+		status string
+	)
+	err := row.Scan(&job.ID, &job.Slug, &mode, &status, &job.TotalRows, &job.ProcessedRows, &job.ChangedRows, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return job, err
+	}
+	job.Mode = models.ImportMode(mode)
+	job.Status = models.ImportStatus(status)
+	return job, nil
+}
@@ -0,0 +1,473 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/rules"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+// Транзакции пересчета материализованных сегментов выполняются по одной, даже если запущено несколько экземпляров
+// сервиса, поэтому фоновый и ручной пересчет не добавляют одного пользователя в сегмент дважды
+const ruleLockKey = 7351244931
+
+type ruleMembership struct {
+	user int64
+	slug string
+}
+
+type ruleMembershipState struct {
+	exists  bool
+	expired bool
+	byRule  bool
+}
+
+// RecomputeRuleSegments пересчитывает материализованные сегменты, правило или режим которых изменились,
+// а затем пользователей из очереди, атрибуты которых изменились. Возвращает пользователей, членство которых изменилось
+func (s *SQLStorage) RecomputeRuleSegments() []int64 {
+
+	ctx := context.Background()
+
+	changed := make([]int64, 0)
+	seen := make(map[int64]bool)
+	collect := func(users []int64) {
+		for _, user := range users {
+			if !seen[user] {
+				seen[user] = true
+				changed = append(changed, user)
+			}
+		}
+	}
+
+	query := `SELECT slug FROM segments WHERE rule_dirty AND deleted_at IS NULL ORDER BY slug`
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		s.logger.Errorw("error",
+			"RecomputeRuleSegments: selection of changed segments failed ", err,
+		)
+		return changed
+	}
+	defer rows.Close()
+
+	dirty := make([]string, 0)
+	for rows.Next() {
+		var slug string
+		err = rows.Scan(&slug)
+		if err != nil {
+			s.logger.Errorw("error",
+				"RecomputeRuleSegments: enumerating changed segments failed ", err,
+			)
+			return changed
+		}
+		dirty = append(dirty, slug)
+	}
+	err = rows.Err()
+	if err != nil {
+		s.logger.Errorw("error",
+			"RecomputeRuleSegments: enumerating changed segments failed ", err,
+		)
+		return changed
+	}
+
+	for _, slug := range dirty {
+		result, users, err := s.recomputeSegment(ctx, slug)
+		if err != nil {
+			s.logger.Errorw("error",
+				"RecomputeRuleSegments: recomputing segment "+slug+" failed ", err,
+			)
+			continue
+		}
+		collect(users)
+		s.logger.Infow("info",
+			"RecomputeRuleSegments: recomputed segment "+slug+": ", result,
+		)
+	}
+
+	for {
+		users, processed, err := s.recomputeQueuedUsers(ctx)
+		if err != nil {
+			s.logger.Errorw("error",
+				"RecomputeRuleSegments: recomputing queued users failed ", err,
+			)
+			break
+		}
+		collect(users)
+		if processed < s.rules.BatchSize {
+			break
+		}
+	}
+	return changed
+}
+
+// RecomputeSegment пересчитывает членство в материализованном сегменте для всех пользователей.
+// Для сегмента без правила, с правилом, которое не удалось разобрать, или не материализованного
+// удаляются все добавленные по правилу строки членства
+func (s *SQLStorage) RecomputeSegment(ctx context.Context, slug string) (_ models.RecomputeResult, err error) {
+	defer func() { err = mapError(err) }()
+
+	result, _, err := s.recomputeSegment(ctx, slug)
+	return result, err
+}
+
+func (s *SQLStorage) recomputeSegment(ctx context.Context, slug string) (models.RecomputeResult, []int64, error) {
+
+	var (
+		result       models.RecomputeResult
+		source       string
+		materialized bool
+		archived     bool
+	)
+
+	query := `SELECT coalesce(rule, ''), materialized, deleted_at IS NOT NULL FROM segments WHERE slug = $1`
+	err := s.pool.QueryRow(ctx, query, slug).Scan(&source, &materialized, &archived)
+	if err == pgx.ErrNoRows {
+		return result, nil, storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return result, nil, err
+	}
+	if archived {
+		return result, nil, fmt.Errorf("%w: %s", storage.ErrSegmentArchived, slug)
+	}
+
+	changed := make([]int64, 0)
+
+	// Под правило, которое не удалось разобрать, не подходит ни один пользователь
+	var rule *rules.Rule
+	if source != "" && materialized {
+		rule = s.parseRule(slug, source)
+	}
+
+	if rule == nil {
+		removed, err := s.clearRuleMemberships(ctx, slug)
+		if err != nil {
+			return result, nil, err
+		}
+		result.Removed = int64(len(removed))
+		changed = removed
+	} else {
+		segments := []ruleSegment{{slug: slug, rule: rule}}
+
+		// Пользователи перебираются страницами по идентификатору, каждая страница пересчитывается в своей транзакции
+		var after int64
+		for {
+			query := `SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT $2`
+			rows, err := s.pool.Query(ctx, query, after, s.rules.BatchSize)
+			if err != nil {
+				return result, nil, err
+			}
+			users, err := collectUsers(rows)
+			if err != nil {
+				return result, nil, err
+			}
+			if len(users) == 0 {
+				break
+			}
+
+			page, pageChanged, err := s.recomputeUsersPage(ctx, segments, users)
+			if err != nil {
+				return result, nil, err
+			}
+			result.Added += page.Added
+			result.Removed += page.Removed
+			changed = append(changed, pageChanged...)
+
+			if len(users) < s.rules.BatchSize {
+				break
+			}
+			after = users[len(users)-1]
+		}
+	}
+
+	// Снимаем отметку, только если правило и режим не изменились во время пересчета
+	query = `	UPDATE segments SET rule_dirty = false
+				WHERE slug = $1 AND coalesce(rule, '') = $2 AND materialized = $3`
+	_, err = s.pool.Exec(ctx, query, slug, source, materialized)
+	if err != nil {
+		return result, nil, err
+	}
+	return result, changed, nil
+}
+
+// Удаляем из сегмента всех пользователей, добавленных по правилу, добавленные вручную остаются
+func (s *SQLStorage) clearRuleMemberships(ctx context.Context, slug string) ([]int64, error) {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, ruleLockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `	WITH removed AS (
+					DELETE FROM users_segments
+					WHERE segment_slug = $1 AND reason = $2
+					RETURNING user_id, segment_slug
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time, reason)
+				SELECT user_id, segment_slug, $3, now(), $2 FROM removed
+				RETURNING user_id`
+	rows, err := tx.Query(ctx, query, slug, string(models.ReasonRule), string(models.ActionRemove))
+	if err != nil {
+		return nil, err
+	}
+	removed, err := collectUsers(rows)
+	if err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit(ctx)
+}
+
+// Забираем из очереди пачку пользователей и пересчитываем для них все материализованные сегменты.
+// Пользователи удаляются из очереди в той же транзакции, поэтому при ошибке они останутся в очереди
+func (s *SQLStorage) recomputeQueuedUsers(ctx context.Context) ([]int64, int, error) {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, ruleLockKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `	DELETE FROM rule_queue
+				WHERE user_id IN (
+					SELECT user_id FROM rule_queue
+					ORDER BY queued_at
+					LIMIT $1
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING user_id`
+	rows, err := tx.Query(ctx, query, s.rules.BatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, err := collectUsers(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(users) == 0 {
+		return nil, 0, nil
+	}
+
+	segments, err := s.getRuleSegments(ctx, tx, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, changed, err := s.recomputeUsers(ctx, tx, segments, users)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if result.Added != 0 || result.Removed != 0 {
+		s.logger.Infow("info",
+			"RecomputeRuleSegments: recomputed queued users: ", len(users), " ", result,
+		)
+	}
+	return changed, len(users), nil
+}
+
+func (s *SQLStorage) recomputeUsersPage(ctx context.Context, segments []ruleSegment, users []int64) (models.RecomputeResult, []int64, error) {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.RecomputeResult{}, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, ruleLockKey)
+	if err != nil {
+		return models.RecomputeResult{}, nil, err
+	}
+
+	result, changed, err := s.recomputeUsers(ctx, tx, segments, users)
+	if err != nil {
+		return result, nil, err
+	}
+	return result, changed, tx.Commit(ctx)
+}
+
+// Сравниваем правила сегментов с атрибутами пользователей и приводим хранимое членство в соответствие:
+// подходящий пользователь добавляется, если он не состоит в сегменте или его членство истекло,
+// неподходящий удаляется, только если был добавлен по правилу
+func (s *SQLStorage) recomputeUsers(ctx context.Context, tx pgx.Tx, segments []ruleSegment, users []int64) (models.RecomputeResult, []int64, error) {
+
+	var result models.RecomputeResult
+	if len(segments) == 0 {
+		return result, nil, nil
+	}
+
+	attributes, err := getUsersAttributes(ctx, tx, users)
+	if err != nil {
+		return result, nil, err
+	}
+
+	slugs := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		slugs = append(slugs, segment.slug)
+	}
+
+	// Блокируем существующие строки членства до конца транзакции
+	query := `	SELECT user_id, segment_slug, coalesce(expires_at < now(), false), coalesce(reason, '') = $3
+				FROM users_segments
+				WHERE user_id = ANY($1::bigint[]) AND segment_slug = ANY($2::text[])
+				ORDER BY user_id, segment_slug
+				FOR UPDATE`
+	rows, err := tx.Query(ctx, query, users, slugs, string(models.ReasonRule))
+	if err != nil {
+		return result, nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[ruleMembership]ruleMembershipState)
+	for rows.Next() {
+		var (
+			key   ruleMembership
+			state ruleMembershipState
+		)
+		err = rows.Scan(&key.user, &key.slug, &state.expired, &state.byRule)
+		if err != nil {
+			return result, nil, err
+		}
+		state.exists = true
+		memberships[key] = state
+	}
+	err = rows.Err()
+	if err != nil {
+		return result, nil, err
+	}
+
+	var addList, removeList []ruleMembership
+	for _, user := range users {
+		attrs, ok := attributes[user]
+		if !ok {
+			continue
+		}
+		for _, segment := range segments {
+			key := ruleMembership{user: user, slug: segment.slug}
+			state := memberships[key]
+
+			matched := segment.rule.Match(attrs)
+			switch {
+			case matched && (!state.exists || state.expired):
+				addList = append(addList, key)
+			case !matched && state.exists && state.byRule:
+				removeList = append(removeList, key)
+			}
+		}
+	}
+
+	err = addRuleMemberships(ctx, tx, addList)
+	if err != nil {
+		return result, nil, err
+	}
+	err = removeRuleMemberships(ctx, tx, removeList)
+	if err != nil {
+		return result, nil, err
+	}
+	result.Added = int64(len(addList))
+	result.Removed = int64(len(removeList))
+
+	changed := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for _, list := range [][]ruleMembership{addList, removeList} {
+		for _, m := range list {
+			if !seen[m.user] {
+				seen[m.user] = true
+				changed = append(changed, m.user)
+			}
+		}
+	}
+	return result, changed, nil
+}
+
+func collectUsers(rows pgx.Rows) ([]int64, error) {
+	defer rows.Close()
+
+	users := make([]int64, 0)
+	for rows.Next() {
+		var user int64
+		err := rows.Scan(&user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func splitMemberships(list []ruleMembership) ([]int64, []string) {
+	users := make([]int64, 0, len(list))
+	slugs := make([]string, 0, len(list))
+	for _, m := range list {
+		users = append(users, m.user)
+		slugs = append(slugs, m.slug)
+	}
+	return users, slugs
+}
+
+// Добавление по правилу пишется в историю так же, как ручное: истекшее членство фиксируется удалением
+// и повторным добавлением. Строки членства блокируются до вызова в recomputeUsers
+func addRuleMemberships(ctx context.Context, tx pgx.Tx, list []ruleMembership) error {
+
+	if len(list) == 0 {
+		return nil
+	}
+	users, slugs := splitMemberships(list)
+
+	query := `	WITH changes AS (
+					SELECT a.user_id, a.segment_slug, us.user_id IS NOT NULL AS expired
+					FROM unnest($1::bigint[], $2::text[]) AS a(user_id, segment_slug)
+					LEFT JOIN users_segments us ON us.user_id = a.user_id AND us.segment_slug = a.segment_slug
+				), upserted AS (
+					INSERT INTO users_segments (user_id, segment_slug, expires_at, reason)
+					SELECT user_id, segment_slug, null, $3::text FROM changes
+					ON CONFLICT (user_id, segment_slug) DO UPDATE
+					SET expires_at = null,
+						joined_at = now(),
+						reason = EXCLUDED.reason
+				), expired_history AS (
+					INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+					SELECT user_id, segment_slug, $4::text, now() FROM changes
+					WHERE expired
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time, reason)
+				SELECT user_id, segment_slug, $5::text, now(), $3::text FROM changes`
+	_, err := tx.Exec(ctx, query, users, slugs, string(models.ReasonRule), string(models.ActionRemove), string(models.ActionAdd))
+	return err
+}
+
+func removeRuleMemberships(ctx context.Context, tx pgx.Tx, list []ruleMembership) error {
+
+	if len(list) == 0 {
+		return nil
+	}
+	users, slugs := splitMemberships(list)
+
+	query := `	WITH removed AS (
+					DELETE FROM users_segments us
+					USING unnest($1::bigint[], $2::text[]) AS r(user_id, segment_slug)
+					WHERE us.user_id = r.user_id AND us.segment_slug = r.segment_slug AND us.reason = $3::text
+					RETURNING us.user_id, us.segment_slug
+				)
+				INSERT INTO segments_history (user_id, segment_slug, action, action_time, reason)
+				SELECT user_id, segment_slug, $4::text, now(), $3::text FROM removed`
+	_, err := tx.Exec(ctx, query, users, slugs, string(models.ReasonRule), string(models.ActionRemove))
+	return err
+}
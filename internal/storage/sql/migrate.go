@@ -0,0 +1,486 @@
+package sql
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Миграции применяются под advisory lock с этим ключом, поэтому при одновременном запуске
+// нескольких экземпляров сервиса миграции применяет только один из них, остальные ждут
+const migrationLockKey = 7351244930
+
+// Файлы миграций называются <версия>_<название>.up.sql и <версия>_<название>.down.sql
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Файл, который начинается с этой строки, выполняется без общей транзакции, каждый запрос отдельно.
+// Так выполняются миграции, которые не должны блокировать таблицы надолго: CREATE INDEX CONCURRENTLY
+// и изменение данных пачками нельзя выполнить внутри одной транзакции
+const noTransactionMarker = "-- migrate:no-transaction"
+
+// Необязательные миграции применяются, только если включены в конфигурации
+const historyPartitioningMigration = "history_partitioning"
+
+var optionalMigrations = map[string]bool{
+	historyPartitioningMigration: true,
+}
+
+type migration struct {
+	version  int64
+	name     string
+	up       string
+	down     string
+	optional bool
+
+	upNoTransaction   bool
+	downNoTransaction bool
+}
+
+// MigrationStatus - состояние миграции, AppliedAt не заполнено для еще не примененной миграции,
+// Disabled отмечает необязательную миграцию, которая не включена в конфигурации
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+	Disabled  bool
+}
+
+// Migrator применяет и откатывает миграции схемы, каждая миграция выполняется в отдельной транзакции
+// вместе с записью в schema_migrations, поэтому прерванная миграция не оставляет схему в промежуточном состоянии.
+// Миграция без транзакции записывается в schema_migrations только после всех своих запросов,
+// поэтому прерванная миграция выполняется заново и должна допускать повторное выполнение
+type Migrator struct {
+	pool       *pgxpool.Pool
+	logger     *zap.SugaredLogger
+	migrations []migration
+	enabled    map[string]bool
+}
+
+// NewMigrator подключается к базе данных только для работы с миграциями, без запуска хранилища
+func NewMigrator(cfg config.Database, logger *zap.SugaredLogger) (*Migrator, error) {
+
+	pool, err := openPool(context.Background(), cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrator(pool, cfg, logger)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMigrator(pool *pgxpool.Pool, cfg config.Database, logger *zap.SugaredLogger) (*Migrator, error) {
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		pool:       pool,
+		logger:     logger,
+		migrations: migrations,
+		enabled: map[string]bool{
+			historyPartitioningMigration: cfg.HistoryPartitioning,
+		},
+	}, nil
+}
+
+// Close закрывает соединения с базой данных
+func (m *Migrator) Close() {
+	m.pool.Close()
+}
+
+func loadMigrations() ([]migration, error) {
+
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("wrong migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		data, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version, name: match[2], optional: optionalMigrations[match[2]]}
+			byVersion[version] = mig
+		}
+		if mig.name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names %s and %s", version, mig.name, match[2])
+		}
+		noTransaction := strings.HasPrefix(string(data), noTransactionMarker)
+		if match[3] == "up" {
+			mig.up = string(data)
+			mig.upNoTransaction = noTransaction
+		} else {
+			mig.down = string(data)
+			mig.downNoTransaction = noTransaction
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == "" || mig.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", mig.version, mig.name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// Up применяет все еще не примененные миграции по возрастанию версии и возвращает их количество.
+// Необязательные миграции, которые не включены в конфигурации, пропускаются и могут быть применены позже
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+
+	count := 0
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.version]; ok || m.disabled(mig) {
+				continue
+			}
+
+			err = m.apply(ctx, conn, mig, true)
+			if err != nil {
+				return fmt.Errorf("applying migration %d_%s: %w", mig.version, mig.name, err)
+			}
+			m.logger.Infow("info",
+				"Migrator: applied migration ", fmt.Sprintf("%d_%s", mig.version, mig.name),
+			)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down откатывает steps последних примененных миграций и возвращает количество откаченных
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+
+	count := 0
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]int64, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i] > versions[j]
+		})
+
+		for _, version := range versions {
+			if count == steps {
+				break
+			}
+
+			mig, ok := m.find(version)
+			if !ok {
+				return fmt.Errorf("migration %d is applied, but its files are unknown to this version of service", version)
+			}
+
+			err = m.apply(ctx, conn, mig, false)
+			if err != nil {
+				return fmt.Errorf("rolling back migration %d_%s: %w", mig.version, mig.name, err)
+			}
+			m.logger.Infow("info",
+				"Migrator: rolled back migration ", fmt.Sprintf("%d_%s", mig.version, mig.name),
+			)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status возвращает все известные миграции, а также примененные миграции, файлов которых нет в этой версии сервиса
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			status := MigrationStatus{Version: mig.version, Name: mig.name, Disabled: m.disabled(mig)}
+			if record, ok := applied[mig.version]; ok {
+				status.AppliedAt = &record.AppliedAt
+				delete(applied, mig.version)
+			}
+			statuses = append(statuses, status)
+		}
+		for version, record := range applied {
+			appliedAt := record.AppliedAt
+			statuses = append(statuses, MigrationStatus{Version: version, Name: record.Name, AppliedAt: &appliedAt})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Если схема не обновляется при старте, то сервис не должен работать со схемой, в которой не хватает миграций
+func (m *Migrator) checkPending(ctx context.Context) error {
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil && !status.Disabled {
+			return fmt.Errorf("migration %d_%s is not applied, run migrate up", status.Version, status.Name)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) disabled(mig migration) bool {
+	return mig.optional && !m.enabled[mig.name]
+}
+
+func (m *Migrator) find(version int64) (migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.version == version {
+			return mig, true
+		}
+	}
+	return migration{}, false
+}
+
+// Выполняем SQL миграции и изменяем schema_migrations в одной транзакции
+func (m *Migrator) apply(ctx context.Context, conn *pgx.Conn, mig migration, up bool) error {
+
+	script, noTransaction := mig.down, mig.downNoTransaction
+	if up {
+		script, noTransaction = mig.up, mig.upNoTransaction
+	}
+	if noTransaction {
+		return m.applyNoTransaction(ctx, conn, mig, script, up)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Файл миграции может содержать несколько запросов, без параметров они выполняются простым протоколом
+	_, err = tx.Exec(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	if up {
+		query := `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())`
+		_, err = tx.Exec(ctx, query, mig.version, mig.name)
+	} else {
+		query := `DELETE FROM schema_migrations WHERE version = $1`
+		_, err = tx.Exec(ctx, query, mig.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Каждый запрос выполняется отдельно и фиксируется сразу, а запись в schema_migrations делается последней
+func (m *Migrator) applyNoTransaction(ctx context.Context, conn *pgx.Conn, mig migration, script string, up bool) error {
+
+	for _, statement := range splitStatements(script) {
+		_, err := conn.Exec(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if up {
+		query := `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())`
+		_, err = conn.Exec(ctx, query, mig.version, mig.name)
+	} else {
+		query := `DELETE FROM schema_migrations WHERE version = $1`
+		_, err = conn.Exec(ctx, query, mig.version)
+	}
+	return err
+}
+
+// splitStatements делит файл миграции на запросы по точке с запятой. Точка с запятой внутри строк,
+// идентификаторов в кавычках, комментариев и тел функций в $$ запрос не завершает
+func splitStatements(script string) []string {
+
+	var (
+		statements []string
+		start      int
+	)
+	add := func(statement string) {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	for i := 0; i < len(script); i++ {
+		switch {
+		case script[i] == ';':
+			add(script[start:i])
+			start = i + 1
+		case script[i] == '\'' || script[i] == '"':
+			end := strings.IndexByte(script[i+1:], script[i])
+			if end < 0 {
+				i = len(script)
+				break
+			}
+			i += end + 1
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+				break
+			}
+			i += end
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+				break
+			}
+			i += end + 3
+		case script[i] == '$':
+			tag := dollarQuoteTag.FindString(script[i:])
+			if tag == "" {
+				break
+			}
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				i = len(script)
+				break
+			}
+			i += len(tag) + end + len(tag) - 1
+		}
+	}
+	add(script[start:])
+	return statements
+}
+
+var dollarQuoteTag = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// Захватываем отдельное соединение на все время работы с миграциями и держим на нем advisory lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgx.Conn) error) error {
+
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Миграции и ожидание блокировки могут занимать больше времени, чем разрешено обычным запросам
+	_, err = conn.Exec(ctx, `SET statement_timeout = 0`)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	if err != nil {
+		conn.Conn().Close(ctx)
+		return err
+	}
+
+	// Если блокировку не удалось снять, то закрываем соединение, тогда сервер снимет ее сам
+	defer func() {
+		_, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		if err == nil {
+			_, err = conn.Exec(context.Background(), `RESET statement_timeout`)
+		}
+		if err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version bigint primary key,
+		name varchar(255) not null,
+		applied_at timestamp not null)`
+	_, err = conn.Exec(ctx, query)
+	if err != nil {
+		return err
+	}
+	return fn(conn.Conn())
+}
+
+type appliedMigration struct {
+	Name      string
+	AppliedAt time.Time
+}
+
+func appliedMigrations(ctx context.Context, conn *pgx.Conn) (map[int64]appliedMigration, error) {
+
+	applied := make(map[int64]appliedMigration)
+
+	query := `SELECT version, name, applied_at FROM schema_migrations`
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version int64
+			record  appliedMigration
+		)
+		err = rows.Scan(&version, &record.Name, &record.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = record
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,98 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, mig := range migrations {
+		if i > 0 && mig.version <= migrations[i-1].version {
+			t.Errorf("migration %d_%s is out of order", mig.version, mig.name)
+		}
+		if mig.optional != (mig.name == historyPartitioningMigration) {
+			t.Errorf("migration %d_%s: optional = %v", mig.version, mig.name, mig.optional)
+		}
+		// Нумерация истории и индексы строятся без общей транзакции, чтобы не блокировать историю
+		if mig.upNoTransaction != (mig.name == "history_indexes") {
+			t.Errorf("migration %d_%s: up without transaction = %v", mig.version, mig.name, mig.upNoTransaction)
+		}
+	}
+}
+
+func TestOptionalMigrationDisabled(t *testing.T) {
+	partitioning := migration{version: 9, name: historyPartitioningMigration, optional: true}
+	regular := migration{version: 8, name: "composite_segments"}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		mig     migration
+		want    bool
+	}{
+		{"optional disabled", false, partitioning, true},
+		{"optional enabled", true, partitioning, false},
+		{"regular", false, regular, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMigrator(nil, config.Database{HistoryPartitioning: tt.enabled}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.disabled(tt.mig); got != tt.want {
+				t.Errorf("disabled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "plain statements",
+			script: "CREATE TABLE a (id int);\n\nDROP TABLE b;\n",
+			want:   []string{"CREATE TABLE a (id int)", "DROP TABLE b"},
+		},
+		{
+			name:   "comments stay with next statement",
+			script: "-- первый; запрос\nSELECT 1;\n/* второй; */ SELECT 2;\n-- в конце",
+			want:   []string{"-- первый; запрос\nSELECT 1", "/* второй; */ SELECT 2", "-- в конце"},
+		},
+		{
+			name:   "quoted semicolons",
+			script: `SELECT 'a;''b'; SELECT "c;d" FROM t;`,
+			want:   []string{`SELECT 'a;''b'`, `SELECT "c;d" FROM t`},
+		},
+		{
+			name:   "dollar quoted body",
+			script: "DO $$\nBEGIN\n    PERFORM 1;\n    COMMIT;\nEND\n$$;\nSELECT $tag$;$tag$;",
+			want:   []string{"DO $$\nBEGIN\n    PERFORM 1;\n    COMMIT;\nEND\n$$", "SELECT $tag$;$tag$"},
+		},
+		{
+			name:   "positional parameter is not a dollar quote",
+			script: "SELECT $1; SELECT 2;",
+			want:   []string{"SELECT $1", "SELECT 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.script); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,4 +6,8 @@ DROP TABLE IF EXISTS segments;
 
 DROP TABLE IF EXISTS users;
 
+DROP TABLE IF EXISTS idempotency_keys;
 
+DROP TABLE IF EXISTS segment_aliases;
+
+DROP TABLE IF EXISTS import_jobs;
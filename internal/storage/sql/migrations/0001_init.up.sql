@@ -0,0 +1,78 @@
+-- Начальная схема. Таблицы раньше создавались при старте сервиса, поэтому миграция
+-- может применяться к уже существующей базе данных и только добавляет недостающее
+
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS segments (
+    slug          varchar(255)     PRIMARY KEY
+);
+
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS description text not null default '',
+    ADD COLUMN IF NOT EXISTS owner varchar(255) not null default '',
+    ADD COLUMN IF NOT EXISTS tags text[] not null default '{}',
+    ADD COLUMN IF NOT EXISTS attributes jsonb,
+    ADD COLUMN IF NOT EXISTS created_at timestamp not null default now(),
+    ADD COLUMN IF NOT EXISTS updated_at timestamp not null default now(),
+    ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+
+CREATE TABLE IF NOT EXISTS users_segments (
+    user_id         integer references users (id) on delete cascade      not null,
+    segment_slug    varchar(255) references segments (slug) on delete cascade   not null,
+    expires_at      timestamp,
+    UNIQUE (user_id, segment_slug)
+);
+
+-- Для уже существующих строк время добавления неизвестно, поэтому значение по умолчанию задаем отдельно
+ALTER TABLE users_segments
+    ADD COLUMN IF NOT EXISTS joined_at timestamp;
+
+ALTER TABLE users_segments
+    ALTER COLUMN joined_at SET DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS segments_history (
+    user_id       int              not null,
+    segment_slug  varchar(255)     not null,
+    action        varchar(32)      not null,
+    action_time   timestamp        not null
+);
+
+-- Раньше действие хранилось как boolean (true - добавление, false - удаление), переводим в текстовый тип
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'segments_history' AND column_name = 'action' AND data_type = 'boolean') THEN
+        ALTER TABLE segments_history ALTER COLUMN action TYPE varchar(32)
+        USING CASE WHEN action THEN 'add' ELSE 'remove' END;
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS segment_aliases (
+    alias         varchar(255)     PRIMARY KEY,
+    slug          varchar(255)     not null,
+    renamed_at    timestamp        not null
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key           varchar(64)      PRIMARY KEY,
+    request_hash  varchar(64)      not null,
+    status_code   integer,
+    body          bytea,
+    expires_at    timestamp        not null
+);
+
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id              bigserial        PRIMARY KEY,
+    segment_slug    varchar(255)     not null,
+    mode            varchar(16)      not null,
+    status          varchar(16)      not null,
+    total_rows      integer          not null,
+    processed_rows  integer          not null default 0,
+    changed_rows    integer          not null default 0,
+    error           text             not null default '',
+    created_at      timestamp        not null default now(),
+    updated_at      timestamp        not null default now(),
+    heartbeat_at    timestamp        not null default now()
+);
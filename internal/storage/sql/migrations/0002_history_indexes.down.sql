@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS segments_history_segment_time_idx;
+
+DROP INDEX IF EXISTS segments_history_user_time_idx;
+
+ALTER TABLE segments_history DROP COLUMN IF EXISTS id;
+
+DROP SEQUENCE IF EXISTS segments_history_id_seq;
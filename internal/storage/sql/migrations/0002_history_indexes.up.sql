@@ -0,0 +1,59 @@
+-- migrate:no-transaction
+-- Миграция выполняется без общей транзакции, каждый запрос отдельно, чтобы история не блокировалась
+-- на время нумерации записей и построения индексов. Все шаги можно безопасно выполнить повторно,
+-- если миграция была прервана. Прерванное построение индекса оставляет невалидный индекс,
+-- такой индекс перед повторным запуском нужно удалить через DROP INDEX CONCURRENTLY
+
+-- Колонка добавляется без значения по умолчанию: значение из последовательности переписало бы всю таблицу.
+-- Значение по умолчанию, заданное отдельно, получают только новые записи
+CREATE SEQUENCE IF NOT EXISTS segments_history_id_seq;
+
+ALTER TABLE segments_history ADD COLUMN IF NOT EXISTS id bigint;
+
+ALTER SEQUENCE segments_history_id_seq OWNED BY segments_history.id;
+
+ALTER TABLE segments_history ALTER COLUMN id SET DEFAULT nextval('segments_history_id_seq');
+
+-- Существующие записи нумеруются пачками по диапазонам страниц таблицы, каждая пачка в своей транзакции.
+-- Обновленные строки могут попасть на страницы за исходной границей, но у них id уже заполнен
+DO $$
+DECLARE
+    pages bigint := pg_relation_size('segments_history') / current_setting('block_size')::bigint;
+    batch bigint := 1000;
+    page  bigint := 0;
+BEGIN
+    WHILE page <= pages LOOP
+        UPDATE segments_history SET id = nextval('segments_history_id_seq')
+        WHERE ctid >= format('(%s,0)', page)::tid AND ctid < format('(%s,0)', page + batch)::tid
+            AND id IS NULL;
+        COMMIT;
+        page := page + batch;
+    END LOOP;
+END
+$$;
+
+-- Проверка ограничения не блокирует запись, а SET NOT NULL при проверенном ограничении не читает таблицу
+ALTER TABLE segments_history DROP CONSTRAINT IF EXISTS segments_history_id_not_null;
+
+ALTER TABLE segments_history ADD CONSTRAINT segments_history_id_not_null CHECK (id IS NOT NULL) NOT VALID;
+
+ALTER TABLE segments_history VALIDATE CONSTRAINT segments_history_id_not_null;
+
+ALTER TABLE segments_history ALTER COLUMN id SET NOT NULL;
+
+ALTER TABLE segments_history DROP CONSTRAINT segments_history_id_not_null;
+
+CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS segments_history_pkey ON segments_history (id);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'segments_history_pkey') THEN
+        ALTER TABLE segments_history ADD CONSTRAINT segments_history_pkey PRIMARY KEY USING INDEX segments_history_pkey;
+    END IF;
+END
+$$;
+
+-- История запрашивается по пользователю или по сегменту за последние дни
+CREATE INDEX CONCURRENTLY IF NOT EXISTS segments_history_user_time_idx ON segments_history (user_id, action_time);
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS segments_history_segment_time_idx ON segments_history (segment_slug, action_time);
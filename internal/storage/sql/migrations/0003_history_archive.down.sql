@@ -0,0 +1 @@
+DROP TABLE IF EXISTS segments_history_archive;
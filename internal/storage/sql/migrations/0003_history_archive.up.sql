@@ -0,0 +1,13 @@
+-- Записи истории старше срока хранения переносятся сюда с теми же идентификаторами
+CREATE TABLE segments_history_archive (
+    id            bigint           PRIMARY KEY,
+    user_id       int              not null,
+    segment_slug  varchar(255)     not null,
+    action        varchar(32)      not null,
+    action_time   timestamp        not null,
+    archived_at   timestamp        not null default now()
+);
+
+CREATE INDEX segments_history_archive_user_time_idx ON segments_history_archive (user_id, action_time);
+
+CREATE INDEX segments_history_archive_time_idx ON segments_history_archive (action_time);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS archive_erasures;
+
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,19 @@
+-- Журнал действий, которые нужно подтверждать и после удаления самих данных, например удаления пользователей
+CREATE TABLE audit_log (
+    id            bigserial        PRIMARY KEY,
+    action        varchar(64)      not null,
+    user_id       bigint,
+    details       jsonb            not null default '{}',
+    created_at    timestamp        not null default now()
+);
+
+CREATE INDEX audit_log_user_idx ON audit_log (user_id);
+
+-- Удаления пользователей, для которых еще нужно переписать архивные файлы истории.
+-- Запись добавляется в транзакции удаления и удаляется после того, как файлы переписаны
+CREATE TABLE archive_erasures (
+    id            bigserial        PRIMARY KEY,
+    user_id       bigint           not null,
+    policy        varchar(16)      not null,
+    created_at    timestamp        not null default now()
+);
@@ -0,0 +1,4 @@
+-- Время регистрации пользователя. У пользователей, появившихся до этой миграции, оно остается пустым,
+-- новые пользователи получают его по умолчанию, в том числе при неявном создании при добавлении в сегменты
+ALTER TABLE users ADD COLUMN created_at timestamp;
+ALTER TABLE users ALTER COLUMN created_at SET DEFAULT now();
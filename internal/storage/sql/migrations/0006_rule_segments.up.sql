@@ -0,0 +1,5 @@
+-- Произвольные атрибуты пользователя, по которым вычисляются правила динамических сегментов
+ALTER TABLE users ADD COLUMN attributes jsonb not null default '{}';
+
+-- Правило динамического сегмента над атрибутами пользователя, у обычных сегментов правила нет
+ALTER TABLE segments ADD COLUMN rule text;
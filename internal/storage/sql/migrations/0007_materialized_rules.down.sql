@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS users_rule_queue_update ON users;
+DROP TRIGGER IF EXISTS users_rule_queue_insert ON users;
+DROP FUNCTION IF EXISTS enqueue_rule_recompute();
+DROP TABLE IF EXISTS rule_queue;
+
+ALTER TABLE segments_history_archive DROP COLUMN IF EXISTS reason;
+ALTER TABLE segments_history DROP COLUMN IF EXISTS reason;
+ALTER TABLE users_segments DROP COLUMN IF EXISTS reason;
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS materialized,
+    DROP COLUMN IF EXISTS rule_dirty;
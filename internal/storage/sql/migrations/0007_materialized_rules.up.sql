@@ -0,0 +1,33 @@
+-- Членство в материализованном сегменте с правилом хранится в users_segments и не вычисляется при чтении.
+-- rule_dirty отмечает сегменты, правило или режим которых изменились и которые нужно пересчитать целиком
+ALTER TABLE segments
+    ADD COLUMN materialized boolean not null default false,
+    ADD COLUMN rule_dirty boolean not null default false;
+
+-- Строки членства, добавленные по правилу, отличаются от добавленных вручную, пересчет удаляет только их
+ALTER TABLE users_segments ADD COLUMN reason varchar(32);
+
+-- Причина изменения, для изменений по правилу - rule, для остальных изменений не заполняется
+ALTER TABLE segments_history ADD COLUMN reason varchar(32);
+ALTER TABLE segments_history_archive ADD COLUMN reason varchar(32);
+
+-- Пользователи, которые появились или атрибуты которых изменились после последнего пересчета.
+-- Очередь заполняется триггером, поэтому в нее попадают и пользователи, созданные неявно при добавлении в сегменты
+CREATE TABLE rule_queue (
+    user_id       bigint           PRIMARY KEY,
+    queued_at     timestamp        not null default now()
+);
+
+CREATE FUNCTION enqueue_rule_recompute() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO rule_queue (user_id, queued_at) VALUES (NEW.id, now())
+    ON CONFLICT (user_id) DO NOTHING;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_rule_queue_insert AFTER INSERT ON users
+    FOR EACH ROW EXECUTE FUNCTION enqueue_rule_recompute();
+
+CREATE TRIGGER users_rule_queue_update AFTER UPDATE OF attributes ON users
+    FOR EACH ROW WHEN (OLD.attributes IS DISTINCT FROM NEW.attributes) EXECUTE FUNCTION enqueue_rule_recompute();
@@ -0,0 +1,4 @@
+ALTER TABLE segments DROP CONSTRAINT IF EXISTS segments_rule_or_composition;
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS composite_op,
+    DROP COLUMN IF EXISTS composite_of;
@@ -0,0 +1,9 @@
+-- Составной сегмент задается операцией union, intersect или difference над другими сегментами.
+-- Сегменты указываются названиями, при переименовании сегмента названия в составе обновляются
+ALTER TABLE segments
+    ADD COLUMN composite_op varchar(16),
+    ADD COLUMN composite_of text[];
+
+-- Сегмент задается либо правилом, либо составом, но не тем и другим одновременно
+ALTER TABLE segments ADD CONSTRAINT segments_rule_or_composition
+    CHECK (rule IS NULL OR composite_op IS NULL);
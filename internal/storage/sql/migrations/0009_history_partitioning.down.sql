@@ -0,0 +1,14 @@
+-- История копируется в обычную таблицу, поэтому на время отката запись в историю блокируется.
+-- Последовательность отвязываем от колонки, иначе она будет удалена вместе с секционированной таблицей
+ALTER SEQUENCE segments_history_id_seq OWNED BY NONE;
+ALTER TABLE segments_history RENAME TO segments_history_partitioned;
+
+CREATE TABLE segments_history (LIKE segments_history_partitioned INCLUDING DEFAULTS);
+INSERT INTO segments_history SELECT * FROM segments_history_partitioned;
+DROP TABLE segments_history_partitioned;
+
+ALTER TABLE segments_history ADD PRIMARY KEY (id);
+ALTER SEQUENCE segments_history_id_seq OWNED BY segments_history.id;
+
+CREATE INDEX segments_history_user_time_idx ON segments_history (user_id, action_time);
+CREATE INDEX segments_history_segment_time_idx ON segments_history (segment_slug, action_time);
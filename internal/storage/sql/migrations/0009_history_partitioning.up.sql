@@ -0,0 +1,30 @@
+-- Необязательная миграция, применяется только при включенном секционировании истории (HISTORY_PARTITIONING).
+-- segments_history переводится в таблицу, секционированную по месяцам action_time: вся существующая история
+-- становится одной партицией segments_history_legacy до конца текущего месяца, новые месяцы получают свои партиции.
+-- Подключение старой таблицы проверяет все ее строки, поэтому на время перевода запись в историю блокируется
+DO $$
+BEGIN
+    -- Раньше история секционировалась при старте сервиса без записи в schema_migrations
+    IF (SELECT relkind FROM pg_class WHERE oid = 'segments_history'::regclass) = 'p' THEN
+        RETURN;
+    END IF;
+
+    -- Имена индексов уникальны в схеме, поэтому индексы старой таблицы переименовываем,
+    -- при подключении партиции они станут партициями индексов новой таблицы
+    ALTER TABLE segments_history RENAME TO segments_history_legacy;
+    ALTER TABLE segments_history_legacy DROP CONSTRAINT segments_history_pkey;
+    ALTER INDEX segments_history_user_time_idx RENAME TO segments_history_legacy_user_time_idx;
+    ALTER INDEX segments_history_segment_time_idx RENAME TO segments_history_legacy_segment_time_idx;
+
+    -- Колонки копируются из старой таблицы, поэтому миграция не зависит от того, какие колонки добавили миграции после нее
+    CREATE TABLE segments_history (LIKE segments_history_legacy INCLUDING DEFAULTS) PARTITION BY RANGE (action_time);
+    ALTER TABLE segments_history ALTER COLUMN id SET NOT NULL, ADD PRIMARY KEY (id, action_time);
+    ALTER SEQUENCE segments_history_id_seq OWNED BY segments_history.id;
+
+    CREATE INDEX segments_history_user_time_idx ON segments_history (user_id, action_time);
+    CREATE INDEX segments_history_segment_time_idx ON segments_history (segment_slug, action_time);
+
+    -- Граница партиции в DDL может быть только константой, поэтому запрос собирается динамически
+    EXECUTE format('ALTER TABLE segments_history ATTACH PARTITION segments_history_legacy FOR VALUES FROM (MINVALUE) TO (%L)',
+        date_trunc('month', now())::timestamp + interval '1 month');
+END $$;
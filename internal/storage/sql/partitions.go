@@ -0,0 +1,63 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Партиции истории создаются заранее на текущий и столько следующих месяцев,
+// чтобы запись в историю не зависела от того, успела ли отработать фоновая задача
+const historyPartitionsAhead = 3
+
+const partitionBoundLayout = "2006-01-02 15:04:05"
+
+// CreateHistoryPartitions создает партиции истории на текущий и следующие месяцы, если история секционирована
+func (s *SQLStorage) CreateHistoryPartitions() {
+
+	err := s.createHistoryPartitions(context.Background())
+	if err != nil {
+		s.logger.Errorw("error",
+			"CreateHistoryPartitions: creating partitions failed ", err,
+		)
+	}
+}
+
+func (s *SQLStorage) createHistoryPartitions(ctx context.Context) error {
+
+	var (
+		partitioned bool
+		month       time.Time
+	)
+	query := `	SELECT relkind = 'p', date_trunc('month', now())::timestamp
+				FROM pg_class WHERE oid = 'segments_history'::regclass`
+	err := s.pool.QueryRow(ctx, query).Scan(&partitioned, &month)
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		return nil
+	}
+
+	for i := 0; i <= historyPartitionsAhead; i++ {
+		from := month.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS segments_history_%s PARTITION OF segments_history FOR VALUES FROM ('%s') TO ('%s')`,
+			from.Format("2006_01"), from.Format(partitionBoundLayout), to.Format(partitionBoundLayout))
+		_, err = s.pool.Exec(ctx, query)
+
+		// Месяц, в котором история была секционирована, уже покрыт партицией segments_history_legacy
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P17" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
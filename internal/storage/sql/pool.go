@@ -0,0 +1,115 @@
+package sql
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+)
+
+// Пауза между попытками подключения к базе данных при старте удваивается, но не превышает maxConnectBackoff
+const (
+	initialConnectBackoff = 500 * time.Millisecond
+	maxConnectBackoff     = 10 * time.Second
+)
+
+func newPoolConfig(cfg config.Database) (*pgxpool.Config, error) {
+
+	// Пароль может содержать любые символы, поэтому собираем DSN как URL с экранированием
+	DSN := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.POSTGRES_USER, cfg.POSTGRES_PASSWORD),
+		Host:     net.JoinHostPort(cfg.DATABASE_HOST, cfg.POSTGRES_PORT),
+		Path:     cfg.POSTGRES_DB,
+		RawQuery: "sslmode=disable",
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(DSN.String())
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig.MaxConns = cfg.MaxConns
+	poolConfig.MinConns = cfg.MinConns
+	poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+	poolConfig.ConnConfig.ConnectTimeout = cfg.ConnectTimeout
+
+	// Ограничение времени выполнения запроса действует на стороне сервера для всех запросов соединения
+	if cfg.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+
+	// Подготовленные запросы кэшируются в каждом соединении, нулевой размер кэша отключает подготовку запросов,
+	// например для работы через PgBouncer в режиме транзакций
+	poolConfig.ConnConfig.StatementCacheCapacity = cfg.StatementCache
+	if cfg.StatementCache == 0 {
+		poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+	}
+	return poolConfig, nil
+}
+
+// Проверяем подключение к базе данных, при неудаче повторяем попытку retries раз с растущей паузой,
+// так как при одновременном запуске с базой данных она может быть еще не готова принимать соединения
+func pingWithRetry(ctx context.Context, pool *pgxpool.Pool, retries int, logger *zap.SugaredLogger) error {
+
+	backoff := initialConnectBackoff
+	for attempt := 0; ; attempt++ {
+		err := pool.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+
+		logger.Infow("info",
+			"NewStorage: database is not available, retrying in ", backoff,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// Создаем пул соединений и дожидаемся доступности базы данных
+func openPool(ctx context.Context, cfg config.Database, logger *zap.SugaredLogger) (*pgxpool.Pool, error) {
+
+	poolConfig, err := newPoolConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pingWithRetry(ctx, pool, cfg.ConnectRetries, logger)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Close закрывает все соединения пула
+func (s *SQLStorage) Close() {
+	s.pool.Close()
+}
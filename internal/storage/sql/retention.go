@@ -0,0 +1,506 @@
+package sql
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+)
+
+// Каждая пачка записывается в отдельный файл, названный по дате архивирования и первому идентификатору пачки:
+// segments_history_YYYY-MM-DD_<id>.ndjson.gz. Файл не дописывается, поэтому сбой во время записи
+// не может испортить уже записанные пачки
+const (
+	archiveFilePrefix = "segments_history_"
+	archiveFileSuffix = ".ndjson.gz"
+	archiveDateLayout = "2006-01-02"
+)
+
+// Строка архивного файла, идентификатор позволяет отбросить повторы, если запись попала в архив дважды
+type archivedHistory struct {
+	ID         int64     `json:"id"`
+	User       int64     `json:"user_id"`
+	Slug       string    `json:"segment"`
+	Action     string    `json:"action"`
+	ActionTime time.Time `json:"action_time"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// ArchiveHistory переносит записи истории старше срока хранения в архив и удаляет устаревшие записи архива.
+// Записи переносятся пачками в отдельных транзакциях, чтобы не держать долгие блокировки на таблице истории
+func (s *SQLStorage) ArchiveHistory() {
+
+	ctx := context.Background()
+
+	err := s.processArchiveErasures(ctx)
+	if err != nil {
+		s.logger.Errorw("error",
+			"ArchiveHistory: erasing users in archive files failed ", err,
+		)
+	}
+
+	if s.history.Retention > 0 {
+		moved := 0
+		for {
+			count, err := s.archiveHistoryBatch(ctx)
+			if err != nil {
+				s.logger.Errorw("error",
+					"ArchiveHistory: archiving history failed ", err,
+				)
+				return
+			}
+			moved += count
+			if count < s.history.BatchSize {
+				break
+			}
+		}
+		s.logger.Infow("info",
+			"ArchiveHistory: successfully archived history records: ", moved,
+		)
+	}
+
+	if s.history.ArchiveRetention > 0 {
+		err := s.purgeHistoryArchive(ctx)
+		if err != nil {
+			s.logger.Errorw("error",
+				"ArchiveHistory: purging history archive failed ", err,
+			)
+		}
+	}
+}
+
+// Переносим одну пачку самых старых записей и возвращаем их количество
+func (s *SQLStorage) archiveHistoryBatch(ctx context.Context) (int, error) {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	retention := s.history.Retention.Seconds()
+
+	var count int64
+	switch s.history.Archive {
+	case "table":
+		query := `	WITH moved AS (
+						DELETE FROM segments_history
+						WHERE (id, action_time) IN (
+							SELECT id, action_time FROM segments_history
+							WHERE action_time < now() - $1 * interval '1 second'
+							LIMIT $2
+						)
+						RETURNING id, user_id, segment_slug, action, action_time, reason
+					)
+					INSERT INTO segments_history_archive (id, user_id, segment_slug, action, action_time, reason, archived_at)
+					SELECT id, user_id, segment_slug, action, action_time, reason, now() FROM moved
+					ON CONFLICT (id) DO NOTHING`
+		tag, err := tx.Exec(ctx, query, retention, s.history.BatchSize)
+		if err != nil {
+			return 0, err
+		}
+		count = tag.RowsAffected()
+
+	case "file":
+		records, err := selectExpiredHistory(ctx, tx, retention, s.history.BatchSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(records) == 0 {
+			return 0, nil
+		}
+
+		// Пачка записывается в файл до удаления из базы данных, поэтому при сбое между записью и удалением
+		// записи попадут в архив повторно, но не потеряются. В тот же день повторная пачка начинается
+		// с того же идентификатора и заменяет файл первой попытки
+		err = s.writeArchiveBatch(records)
+		if err != nil {
+			return 0, err
+		}
+
+		ids := make([]int64, 0, len(records))
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		query := `DELETE FROM segments_history WHERE id = ANY($1)`
+		_, err = tx.Exec(ctx, query, ids)
+		if err != nil {
+			return 0, err
+		}
+		count = int64(len(records))
+
+	default:
+		query := `	DELETE FROM segments_history
+					WHERE (id, action_time) IN (
+						SELECT id, action_time FROM segments_history
+						WHERE action_time < now() - $1 * interval '1 second'
+						LIMIT $2
+					)`
+		tag, err := tx.Exec(ctx, query, retention, s.history.BatchSize)
+		if err != nil {
+			return 0, err
+		}
+		count = tag.RowsAffected()
+	}
+
+	return int(count), tx.Commit(ctx)
+}
+
+func selectExpiredHistory(ctx context.Context, tx pgx.Tx, retention float64, limit int) ([]archivedHistory, error) {
+
+	records := make([]archivedHistory, 0)
+
+	query := `	SELECT id, user_id, segment_slug, action, action_time, coalesce(reason, '') FROM segments_history
+				WHERE action_time < now() - $1 * interval '1 second'
+				ORDER BY id
+				LIMIT $2
+				FOR UPDATE`
+	rows, err := tx.Query(ctx, query, retention, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record archivedHistory
+		err = rows.Scan(&record.ID, &record.User, &record.Slug, &record.Action, &record.ActionTime, &record.Reason)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Пачка записывается во временный файл, который затем атомарно переименовывается, поэтому
+// при остановке процесса во время записи в каталоге архива не остается оборванного файла
+func (s *SQLStorage) writeArchiveBatch(records []archivedHistory) error {
+
+	s.archiveMu.Lock()
+	defer s.archiveMu.Unlock()
+
+	err := os.MkdirAll(s.history.ArchiveDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s%s_%d%s", archiveFilePrefix, time.Now().UTC().Format(archiveDateLayout), records[0].ID, archiveFileSuffix)
+	return writeArchiveFile(filepath.Join(s.history.ArchiveDir, name), records)
+}
+
+// Записи архива старше срока хранения архива удаляются из таблицы пачками, а файлы удаляются целиком,
+// когда все записи в них гарантированно старше этого срока
+func (s *SQLStorage) purgeHistoryArchive(ctx context.Context) error {
+
+	keep := s.history.ArchiveRetention.Seconds()
+
+	purged := int64(0)
+	for {
+		query := `	DELETE FROM segments_history_archive
+					WHERE id IN (
+						SELECT id FROM segments_history_archive
+						WHERE action_time < now() - $1 * interval '1 second'
+						LIMIT $2
+					)`
+		tag, err := s.pool.Exec(ctx, query, keep, s.history.BatchSize)
+		if err != nil {
+			return err
+		}
+		purged += tag.RowsAffected()
+		if tag.RowsAffected() < int64(s.history.BatchSize) {
+			break
+		}
+	}
+
+	s.archiveMu.Lock()
+	defer s.archiveMu.Unlock()
+
+	files, err := s.archiveFiles()
+	if err != nil {
+		return err
+	}
+
+	// В файле за день D только записи старше D + 1 день - Retention
+	deadline := time.Now().UTC().Add(-s.history.ArchiveRetention)
+	for path, archived := range files {
+		if archived.AddDate(0, 0, 1).Add(-s.history.Retention).Before(deadline) {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			purged++
+		}
+	}
+
+	s.logger.Infow("info",
+		"ArchiveHistory: successfully purged archived history records and files: ", purged,
+	)
+	return nil
+}
+
+// Выполняем все удаления пользователей из очереди archive_erasures, которые не удалось выполнить сразу
+func (s *SQLStorage) processArchiveErasures(ctx context.Context) error {
+
+	ids := make([]int64, 0)
+
+	query := `SELECT id FROM archive_erasures ORDER BY id`
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err = s.processArchiveErasure(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Запись очереди блокируется на время перезаписи файлов и удаляется только после нее.
+// Запись, которую уже обрабатывает другой экземпляр сервиса, пропускается
+func (s *SQLStorage) processArchiveErasure(ctx context.Context, id int64) (int64, error) {
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		user   int64
+		policy string
+	)
+	query := `SELECT user_id, policy FROM archive_erasures WHERE id = $1 FOR UPDATE SKIP LOCKED`
+	err = tx.QueryRow(ctx, query, id).Scan(&user, &policy)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	erased, err := s.eraseArchiveFiles(user, models.ErasurePolicy(policy))
+	if err != nil {
+		return 0, err
+	}
+
+	query = `DELETE FROM archive_erasures WHERE id = $1`
+	_, err = tx.Exec(ctx, query, id)
+	if err != nil {
+		return 0, err
+	}
+	return erased, tx.Commit(ctx)
+}
+
+// Переписываем архивные файлы, в которых есть записи пользователя: при anonymize идентификатор пользователя
+// заменяется на 0, при purge записи удаляются. Новое содержимое записывается во временный файл, который затем
+// атомарно заменяет старый, поэтому при сбое файл остается либо старым, либо новым. Возвращает количество измененных записей
+func (s *SQLStorage) eraseArchiveFiles(user int64, policy models.ErasurePolicy) (int64, error) {
+
+	s.archiveMu.Lock()
+	defer s.archiveMu.Unlock()
+
+	files, err := s.archiveFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	erased := int64(0)
+	for path := range files {
+		records := make([]archivedHistory, 0)
+		matched := int64(0)
+		err = readArchiveFile(path, func(record archivedHistory) {
+			if record.User == user {
+				matched++
+				if policy == models.ErasurePurge {
+					return
+				}
+				record.User = 0
+			}
+			records = append(records, record)
+		})
+		if err != nil {
+			return erased, err
+		}
+		if matched == 0 {
+			continue
+		}
+
+		err = writeArchiveFile(path, records)
+		if err != nil {
+			return erased, err
+		}
+		erased += matched
+	}
+	return erased, nil
+}
+
+// Временный файл начинается с точки, поэтому не попадает в список архивных файлов
+func writeArchiveFile(path string, records []archivedHistory) error {
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		err = encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Архивные файлы с датой архивирования, если каталога еще нет, то архив пуст
+func (s *SQLStorage) archiveFiles() (map[string]time.Time, error) {
+
+	files := make(map[string]time.Time)
+
+	entries, err := os.ReadDir(s.history.ArchiveDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, archiveFilePrefix) || !strings.HasSuffix(name, archiveFileSuffix) {
+			continue
+		}
+		date, _, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, archiveFilePrefix), archiveFileSuffix), "_")
+		archived, err := time.Parse(archiveDateLayout, date)
+		if err != nil {
+			continue
+		}
+		files[filepath.Join(s.history.ArchiveDir, name)] = archived
+	}
+	return files, nil
+}
+
+// Читаем из архивных файлов записи пользователей с action_time не раньше since, если segments не пуст,
+// то только по этим сегментам. Записи с идентификаторами из seen пропускаются.
+// Файлы, все записи которых старше since, не читаются
+func (s *SQLStorage) readArchiveFiles(users []int64, segments []string, since time.Time, seen map[int64]bool) ([]models.History, error) {
+
+	history := make([]models.History, 0)
+
+	files, err := s.archiveFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	userSet := make(map[int64]bool, len(users))
+	for _, user := range users {
+		userSet[user] = true
+	}
+	segmentSet := make(map[string]bool, len(segments))
+	for _, slug := range segments {
+		segmentSet[slug] = true
+	}
+
+	// Запас в день на разницу часовых поясов сервиса и базы данных
+	for path, archived := range files {
+		if archived.AddDate(0, 0, 2).Add(-s.history.Retention).Before(since) {
+			continue
+		}
+
+		err = readArchiveFile(path, func(record archivedHistory) {
+			if seen[record.ID] || !userSet[record.User] || record.ActionTime.Before(since) {
+				return
+			}
+			if len(segmentSet) != 0 && !segmentSet[record.Slug] {
+				return
+			}
+			seen[record.ID] = true
+			history = append(history, models.History{
+				User:       record.User,
+				Segment:    models.Segment{Slug: record.Slug},
+				Action:     models.Action(record.Action),
+				ActionTime: record.ActionTime.Format(time.RFC3339Nano),
+				Reason:     models.Reason(record.Reason),
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+func readArchiveFile(path string, fn func(record archivedHistory)) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Файл записывается целиком и атомарно, поэтому ошибка чтения означает, что файл поврежден,
+	// и она не пропускается: иначе выгрузка истории и удаление пользователя молча пропустили бы записи
+	reader, err := gzip.NewReader(file)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading archive file %s: %w", path, err)
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var record archivedHistory
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("reading archive file %s: %w", path, err)
+		}
+		fn(record)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("reading archive file %s: %w", path, err)
+	}
+	return nil
+}
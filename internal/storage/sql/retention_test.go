@@ -0,0 +1,230 @@
+package sql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/h3ll0kitt1/avitotest/internal/config"
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+)
+
+func TestEraseArchiveFiles(t *testing.T) {
+	actionTime := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	records := []archivedHistory{
+		{ID: 1, User: 1000, Slug: "A", Action: "add", ActionTime: actionTime},
+		{ID: 2, User: 1001, Slug: "A", Action: "add", ActionTime: actionTime},
+		{ID: 3, User: 1000, Slug: "B", Action: "remove", ActionTime: actionTime, Reason: "rule"},
+	}
+
+	tests := []struct {
+		policy models.ErasurePolicy
+		want   []archivedHistory
+	}{
+		{models.ErasureAnonymize, []archivedHistory{
+			{ID: 1, User: 0, Slug: "A", Action: "add", ActionTime: actionTime},
+			records[1],
+			{ID: 3, User: 0, Slug: "B", Action: "remove", ActionTime: actionTime, Reason: "rule"},
+		}},
+		{models.ErasurePurge, []archivedHistory{records[1]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s := &SQLStorage{history: config.History{ArchiveDir: t.TempDir()}}
+
+			// Записи попадают в архив двумя пачками, то есть двумя файлами
+			err := s.writeArchiveBatch(records[:2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.writeArchiveBatch(records[2:])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			erased, err := s.eraseArchiveFiles(1000, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if erased != 2 {
+				t.Errorf("erased %d records, want 2", erased)
+			}
+
+			files, err := s.archiveFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 2 {
+				t.Fatalf("got %d archive files, want 2", len(files))
+			}
+			entries, err := os.ReadDir(s.history.ArchiveDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("temporary file left in archive directory: %d entries", len(entries))
+			}
+
+			got := make([]archivedHistory, 0)
+			for _, path := range sortedPaths(files) {
+				err = readArchiveFile(path, func(record archivedHistory) {
+					got = append(got, record)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archive contains %+v, want %+v", got, tt.want)
+			}
+
+			history, err := s.readArchiveFiles([]int64{1000}, nil, actionTime.Add(-time.Hour), map[int64]bool{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 0 {
+				t.Errorf("erased user history is still returned: %+v", history)
+			}
+		})
+	}
+}
+
+func TestEraseArchiveFilesKeepsUntouchedFiles(t *testing.T) {
+	s := &SQLStorage{history: config.History{ArchiveDir: t.TempDir()}}
+	err := s.writeArchiveBatch([]archivedHistory{{ID: 1, User: 1001, Slug: "A", Action: "add", ActionTime: time.Now().UTC()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := s.archiveFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string]time.Time)
+	for path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[path] = info.ModTime()
+	}
+
+	erased, err := s.eraseArchiveFiles(1000, models.ErasurePurge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased != 0 {
+		t.Errorf("erased %d records, want 0", erased)
+	}
+	for path, modTime := range before {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("file %s without user records was rewritten", path)
+		}
+	}
+}
+
+func sortedPaths(files map[string]time.Time) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// truncatedArchive возвращает начало gzip потока с записями, как если бы запись файла оборвалась
+func truncatedArchive(t *testing.T, records []archivedHistory) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()[:buf.Len()/2]
+}
+
+func TestArchiveBatchAfterInterruptedWrite(t *testing.T) {
+	now := time.Now().UTC()
+	s := &SQLStorage{history: config.History{ArchiveDir: t.TempDir()}}
+	first := []archivedHistory{{ID: 1, User: 1000, Slug: "A", Action: "add", ActionTime: now}}
+	second := []archivedHistory{
+		{ID: 2, User: 1000, Slug: "B", Action: "add", ActionTime: now},
+		{ID: 3, User: 1001, Slug: "B", Action: "add", ActionTime: now},
+	}
+
+	err := s.writeArchiveBatch(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Процесс остановился во время записи второй пачки: остался оборванный временный файл,
+	// а записи пачки не удалены из базы данных
+	tmp := filepath.Join(s.history.ArchiveDir, ".segments_history_"+now.Format(archiveDateLayout)+"_2.ndjson.gz.tmp")
+	err = os.WriteFile(tmp, truncatedArchive(t, second), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := s.readArchiveFiles([]int64{1000, 1001}, nil, now.Add(-time.Hour), map[int64]bool{})
+	if err != nil {
+		t.Fatalf("reading archive after interrupted write: %v", err)
+	}
+	if len(history) != 1 || history[0].Segment.Slug != "A" {
+		t.Errorf("history = %+v, want only first batch", history)
+	}
+
+	// Повторная пачка начинается с того же идентификатора, поэтому заменяет оборванный файл
+	err = s.writeArchiveBatch(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(s.history.ArchiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("archive directory has %d entries, want 2 batch files", len(entries))
+	}
+	history, err = s.readArchiveFiles([]int64{1000, 1001}, nil, now.Add(-time.Hour), map[int64]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Errorf("history = %+v, want records of both batches without duplicates", history)
+	}
+}
+
+func TestReadArchiveFileReportsTruncatedStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "segments_history_2023-08-01_1.ndjson.gz")
+	records := make([]archivedHistory, 0, 100)
+	for i := 1; i <= 100; i++ {
+		records = append(records, archivedHistory{ID: int64(i), User: 1000, Slug: "A", Action: "add"})
+	}
+	err := os.WriteFile(path, truncatedArchive(t, records), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Поврежденный файл не пропускается молча, иначе удаление пользователя оставило бы его записи
+	err = readArchiveFile(path, func(archivedHistory) {})
+	if err == nil {
+		t.Error("expected error for truncated archive file")
+	}
+}
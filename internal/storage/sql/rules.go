@@ -0,0 +1,147 @@
+package sql
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/rules"
+)
+
+type ruleSegment struct {
+	slug string
+	rule *rules.Rule
+}
+
+// Разобранные правила кэшируются по тексту правила, поэтому чтение сегментов не разбирает правила заново.
+// Кэш очищается целиком, когда в нем накапливается столько текстов, в основном от уже измененных правил
+const maxParsedRules = 1024
+
+type ruleCache struct {
+	mu    sync.Mutex
+	rules map[string]*rules.Rule
+}
+
+// Правила проверяются при создании и изменении сегмента, поэтому правило, которое не удалось разобрать,
+// везде считается правилом, под которое не подходит ни один пользователь. Ошибка разбора тоже кэшируется,
+// поэтому попадает в журнал один раз, а не при каждом чтении
+func (s *SQLStorage) parseRule(slug string, source string) *rules.Rule {
+
+	s.parsedRules.mu.Lock()
+	defer s.parsedRules.mu.Unlock()
+
+	if rule, ok := s.parsedRules.rules[source]; ok {
+		return rule
+	}
+	if s.parsedRules.rules == nil || len(s.parsedRules.rules) >= maxParsedRules {
+		s.parsedRules.rules = make(map[string]*rules.Rule)
+	}
+
+	rule, err := rules.Parse(source)
+	if err != nil {
+		s.logger.Errorw("error",
+			"parseRule: no users match wrong rule of segment "+slug+" ", err,
+		)
+	}
+	s.parsedRules.rules[source] = rule
+	return rule
+}
+
+// Активные сегменты с правилом, вычисляемые при чтении или материализованные.
+// Сегмент с правилом, которое не удалось разобрать, пропускается
+func (s *SQLStorage) getRuleSegments(ctx context.Context, q querier, materialized bool) ([]ruleSegment, error) {
+
+	segments := make([]ruleSegment, 0)
+
+	query := `SELECT slug, rule FROM segments WHERE rule IS NOT NULL AND materialized = $1 AND deleted_at IS NULL`
+	rows, err := q.Query(ctx, query, materialized)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug, source string
+		err = rows.Scan(&slug, &source)
+		if err != nil {
+			return nil, err
+		}
+
+		rule := s.parseRule(slug, source)
+		if rule == nil {
+			continue
+		}
+		segments = append(segments, ruleSegment{slug: slug, rule: rule})
+	}
+	return segments, rows.Err()
+}
+
+// Атрибуты пользователей, неизвестные пользователи в результат не попадают
+func getUsersAttributes(ctx context.Context, q querier, users []int64) (map[int64]map[string]any, error) {
+
+	attributes := make(map[int64]map[string]any)
+
+	query := `SELECT id, attributes FROM users WHERE id = ANY($1::bigint[])`
+	rows, err := q.Query(ctx, query, users)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			user  int64
+			attrs map[string]any
+		)
+		err = rows.Scan(&user, &attrs)
+		if err != nil {
+			return nil, err
+		}
+		attributes[user] = attrs
+	}
+	return attributes, rows.Err()
+}
+
+// Добавляем к хранимому членству пользователей сегменты, под правила которых подходят их атрибуты.
+// Материализованные сегменты уже есть в хранимом членстве и здесь не вычисляются.
+// Явное членство в сегменте с правилом сохраняет свой TTL, итоговые списки упорядочены по названию сегмента
+func (s *SQLStorage) addRuleSegments(ctx context.Context, q querier, segments map[int64][]models.Segment, users []int64) (map[int64][]models.Segment, error) {
+
+	ruleSegments, err := s.getRuleSegments(ctx, q, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(ruleSegments) == 0 {
+		return segments, nil
+	}
+
+	attributes, err := getUsersAttributes(ctx, q, users)
+	if err != nil {
+		return nil, err
+	}
+
+	for user, attrs := range attributes {
+		explicit := make(map[string]bool, len(segments[user]))
+		for _, segment := range segments[user] {
+			explicit[segment.Slug] = true
+		}
+
+		matched := false
+		for _, ruleSegment := range ruleSegments {
+			if explicit[ruleSegment.slug] || !ruleSegment.rule.Match(attrs) {
+				continue
+			}
+			segments[user] = append(segments[user], models.Segment{Slug: ruleSegment.slug})
+			matched = true
+		}
+
+		if matched {
+			userSegments := segments[user]
+			sort.Slice(userSegments, func(i, j int) bool {
+				return userSegments[i].Slug < userSegments[j].Slug
+			})
+		}
+	}
+	return segments, nil
+}
@@ -0,0 +1,47 @@
+package sql
+
+import (
+	"strconv"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseRuleCachesBySource(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	s := &SQLStorage{logger: zap.New(core).Sugar()}
+
+	first := s.parseRule("A", `city == "Moscow"`)
+	if first == nil {
+		t.Fatal("valid rule was not parsed")
+	}
+	// Другой сегмент с тем же текстом правила получает то же разобранное правило
+	if second := s.parseRule("B", `city == "Moscow"`); second != first {
+		t.Error("rule was parsed again")
+	}
+	if other := s.parseRule("A", `city == "SPb"`); other == nil || other == first {
+		t.Error("changed rule must be parsed separately")
+	}
+
+	for i := 0; i < 3; i++ {
+		if rule := s.parseRule("C", `city ==`); rule != nil {
+			t.Fatal("wrong rule must not match anyone")
+		}
+	}
+	if logs.Len() != 1 {
+		t.Errorf("wrong rule logged %d times, want 1", logs.Len())
+	}
+}
+
+func TestParseRuleCacheIsBounded(t *testing.T) {
+	s := &SQLStorage{logger: zap.NewNop().Sugar()}
+
+	for i := 0; i <= maxParsedRules; i++ {
+		s.parseRule("A", "age == "+strconv.Itoa(i))
+	}
+	if len(s.parsedRules.rules) > maxParsedRules {
+		t.Errorf("cache holds %d rules, limit %d", len(s.parsedRules.rules), maxParsedRules)
+	}
+}
@@ -2,101 +2,136 @@ package sql
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 
 	"github.com/h3ll0kitt1/avitotest/internal/config"
 	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
 )
 
 type SQLStorage struct {
-	db     *sql.DB
-	logger *zap.SugaredLogger
-}
+	pool    *pgxpool.Pool
+	history config.History
+	rules   config.Rules
+	logger  *zap.SugaredLogger
+
+	parsedRules ruleCache
 
-func NewStorage(cfg config.Database, logger *zap.SugaredLogger) (*SQLStorage, error) {
+	// Архивные файлы дописываются, перезаписываются при удалении пользователя и удаляются по сроку хранения
+	// только под этой блокировкой
+	archiveMu sync.Mutex
+}
 
-	DSN := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
-		cfg.DATABASE_HOST, cfg.POSTGRES_USER, cfg.POSTGRES_PASSWORD, cfg.POSTGRES_DB)
+func NewStorage(cfg config.Database, history config.History, rules config.Rules, logger *zap.SugaredLogger) (_ *SQLStorage, err error) {
 
-	db, err := sql.Open("pgx", DSN)
+	ctx := context.Background()
+	pool, err := openPool(ctx, cfg, logger)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			pool.Close()
+		}
+	}()
 
-	tx, err := db.Begin()
+	// Схема обновляется при старте, если это не отключено, иначе проверяем, что все миграции уже применены
+	migrator, err := newMigrator(pool, cfg, logger)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-
-	ctx := context.Background()
-	query := `CREATE TABLE IF NOT EXISTS users(
-		id integer primary key)`
-	_, err = tx.ExecContext(ctx, query)
+	if cfg.AutoMigrate {
+		_, err = migrator.Up(ctx)
+	} else {
+		err = migrator.checkPending(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	query = `CREATE TABLE IF NOT EXISTS segments(
-		slug varchar(255) primary key)`
-	_, err = tx.ExecContext(ctx, query)
-	if err != nil {
-		return nil, err
+	s := &SQLStorage{
+		pool:    pool,
+		history: history,
+		rules:   rules,
+		logger:  logger,
 	}
 
-	query = `CREATE TABLE IF NOT EXISTS users_segments(
-		user_id integer references users (id) on delete cascade not null,
-		segment_slug varchar(255) references segments (slug) on delete cascade not null,
-		expires_at timestamp,
-		unique (user_id, segment_slug))`
-	_, err = tx.ExecContext(ctx, query)
+	// Если история секционирована, то партиция текущего месяца должна существовать до первой записи
+	err = s.createHistoryPartitions(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	query = `CREATE TABLE IF NOT EXISTS segments_history(
-		user_id integer not null,
-		segment_slug varchar(255) not null,
-		action boolean not null,
-		action_time TIMESTAMP not null)`
-	_, err = tx.ExecContext(ctx, query)
+	// Задачи импорта выполняются в памяти процесса, поэтому задачи остановленного процесса продолжить нельзя.
+	// Задачи других реплик с недавним heartbeat_at не затрагиваются
+	_, err = s.failStaleImportJobs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	tx.Commit()
-
-	return &SQLStorage{
-		db:     db,
-		logger: logger,
-	}, nil
+	return s, nil
 }
 
-func (s *SQLStorage) CreateSegment(ctx context.Context, slug string, PercentageRND int) error {
+func (s *SQLStorage) CreateSegment(ctx context.Context, segment models.SegmentInfo, PercentageRND int) (_ models.CreateSegmentResult, err error) {
+	defer func() { err = mapError(err) }()
 
-	tx, err := s.db.Begin()
+	var result models.CreateSegmentResult
+	slug := segment.Slug
+
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return result, err
 	}
-	defer tx.Rollback()
-
-	// Добавляем сегмент, если его не существует
-	query := ` INSERT INTO segments (slug) VALUES ($1) ON CONFLICT (slug) DO NOTHING`
-	_, err = tx.ExecContext(ctx, query, slug)
+	defer tx.Rollback(ctx)
+
+	// Добавляем сегмент с описанием, если его не существует, описание существующего сегмента не меняем
+	// Материализованный сегмент с правилом заполняется фоновой задачей пересчета
+	compositeOp, compositeOf := compositionOrNull(segment.Composition)
+	query := ` INSERT INTO segments (slug, description, owner, tags, attributes, rule, materialized, rule_dirty, composite_op, composite_of)
+				VALUES ($1, $2, $3, $4, $5::jsonb, nullif($6, ''), $7, $6 <> '' AND $7, $8, $9::text[])
+				ON CONFLICT (slug) DO NOTHING`
+	res, err := tx.Exec(ctx, query, slug, segment.Description, segment.Owner, tagsOrEmpty(segment.Tags), attributesOrNull(segment.Attributes), segment.Rule, segment.Materialized, compositeOp, compositeOf)
 	if err != nil {
-		return err
+		return result, err
+	}
+
+	created := res.RowsAffected()
+	result.Created = created == 1
+
+	if result.Created && compositeOp != nil {
+		err = checkComposition(ctx, tx, slug, segment.Composition.Segments)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// Архивный сегмент нельзя создать заново, его можно только восстановить
+	if !result.Created {
+		err = s.checkSegmentActive(ctx, tx, slug)
+		if err != nil {
+			return result, err
+		}
 	}
 
 	// Если было передано значение желаемого процента случайных пользователей
 	if PercentageRND != 0 {
 
+		// Случайных пользователей нельзя добавить в уже существующий составной сегмент
+		err = s.checkSegmentAcceptsUsers(ctx, tx, slug)
+		if err != nil {
+			return result, err
+		}
+
 		// Выбираем случайных пользователей
 		usersRND, err := s.getRandomUsers(ctx, PercentageRND)
 		if err != nil {
-			return err
+			return result, err
 		}
 		s.logger.Infow("info",
 			"CreateSegment: users chosen at random: ", usersRND,
@@ -108,30 +143,149 @@ func (s *SQLStorage) CreateSegment(ctx context.Context, slug string, PercentageR
 			query := ` 	INSERT INTO users_segments (user_id, segment_slug, expires_at) 
 						VALUES ($1, $2, null) 
 						ON CONFLICT (user_id, segment_slug) DO NOTHING`
-			_, err := tx.ExecContext(ctx, query, user, slug)
+			res, err := tx.Exec(ctx, query, user, slug)
 			if err != nil {
-				return err
+				return result, err
+			}
+
+			// Если пользователь уже был в сегменте, то ничего не изменилось и в историю не пишем
+			added := res.RowsAffected()
+			if added == 0 {
+				continue
 			}
 
 			// Добавляем запись о добавлении в историю
-			query = ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
-    					VALUES ($1, $2, true, now())`
-			_, err = tx.ExecContext(ctx, query, user, slug)
+			err = s.addHistory(ctx, tx, user, slug, models.ActionAdd)
 			if err != nil {
-				return err
+				return result, err
 			}
+			result.UsersAdded++
+		}
+	}
+	return result, tx.Commit(ctx)
+}
+
+func (s *SQLStorage) UpdateSegment(ctx context.Context, slug string, patch models.SegmentPatch) (_ models.SegmentInfo, err error) {
+	defer func() { err = mapError(err) }()
+
+	var tags any
+	if patch.Tags != nil {
+		tags = tagsOrEmpty(*patch.Tags)
+	}
+	var attributes any
+	if patch.Attributes != nil {
+		attributes = attributesOrNull(*patch.Attributes)
+	}
+
+	// Пустая операция удаляет состав сегмента
+	var compositeOp, compositeOf any
+	if patch.Composition != nil {
+		compositeOp = string(patch.Composition.Operation)
+		compositeOf = patch.Composition.Segments
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.SegmentInfo{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Переданные как NULL поля остаются без изменений, пустое правило удаляется.
+	// После изменения правила или режима членство по правилу пересчитывается фоновой задачей
+	query := `	UPDATE segments SET
+					description = coalesce($2, description),
+					owner = coalesce($3, owner),
+					tags = coalesce($4::text[], tags),
+					attributes = coalesce($5::jsonb, attributes),
+					rule = CASE WHEN $6::text IS NULL THEN rule ELSE nullif($6, '') END,
+					materialized = coalesce($7, materialized),
+					rule_dirty = rule_dirty OR $6::text IS NOT NULL OR $7::boolean IS NOT NULL,
+					composite_op = CASE WHEN $8::text IS NULL THEN composite_op ELSE nullif($8, '') END,
+					composite_of = CASE WHEN $8::text IS NULL THEN composite_of WHEN $8 = '' THEN NULL ELSE $9::text[] END,
+					updated_at = now()
+				WHERE slug = $1
+				RETURNING ` + segmentInfoColumns
+	row := tx.QueryRow(ctx, query, slug, patch.Description, patch.Owner, tags, attributes, patch.Rule, patch.Materialized, compositeOp, compositeOf)
+
+	segment, err := scanSegmentInfo(row)
+	if err == pgx.ErrNoRows {
+		return segment, storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return segment, err
+	}
+
+	if segment.Composition != nil && patch.Composition != nil {
+		err = checkComposition(ctx, tx, slug, segment.Composition.Segments)
+		if err != nil {
+			return segment, err
+		}
+		err = removeCompositeMembers(ctx, tx, slug)
+		if err != nil {
+			return segment, err
+		}
+	}
+	return segment, tx.Commit(ctx)
+}
+
+func (s *SQLStorage) GetSegment(ctx context.Context, slug string) (_ models.SegmentInfo, err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `SELECT ` + segmentInfoColumns + ` FROM segments WHERE slug = $1`
+	segment, err := scanSegmentInfo(s.pool.QueryRow(ctx, query, slug))
+	if err == pgx.ErrNoRows {
+		return segment, storage.ErrSegmentNotFound
+	}
+	return segment, err
+}
+
+func (s *SQLStorage) GetSegments(ctx context.Context, tag string) (_ []models.SegmentInfo, err error) {
+	defer func() { err = mapError(err) }()
+
+	segments := make([]models.SegmentInfo, 0)
+
+	// Пустой тег означает, что фильтровать по тегам не нужно
+	query := `	SELECT ` + segmentInfoColumns + ` FROM segments
+				WHERE deleted_at IS NULL AND ($1 = '' OR $1 = ANY(tags))
+				ORDER BY slug`
+	rows, err := s.pool.Query(ctx, query, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		segment, err := scanSegmentInfo(rows)
+		if err != nil {
+			return nil, err
 		}
+		segments = append(segments, segment)
 	}
-	return tx.Commit()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
 }
 
-func (s *SQLStorage) DeleteSegment(ctx context.Context, slug string) error {
+func (s *SQLStorage) DeleteSegment(ctx context.Context, slug string) (err error) {
+	defer func() { err = mapError(err) }()
 
-	tx, err := s.db.Begin()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокируем сегмент до конца транзакции, если его нет или он уже в архиве, то удалять нечего
+	query := `SELECT slug FROM segments WHERE slug = $1 AND deleted_at IS NULL FOR UPDATE`
+	err = tx.QueryRow(ctx, query, slug).Scan(&slug)
+	if err == pgx.ErrNoRows {
+		return storage.ErrSegmentNotFound
+	}
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
 	// Получаем список пользователей для которых необходимо удалить сегмент
 	users, err := s.getUsersInSegment(ctx, slug)
@@ -142,50 +296,234 @@ func (s *SQLStorage) DeleteSegment(ctx context.Context, slug string) error {
 		"DeleteSegment: users currently in segment: ", users,
 	)
 
-	// Для каждого пользователя из списка вносим в историю информацию об удалении
+	// Для каждого пользователя из списка вносим в историю информацию об архивировании
 	for _, user := range users {
 
-		query := ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
-					VALUES ($1, $2, false,  now())`
-		_, err := tx.ExecContext(ctx, query, user, slug)
+		err := s.addHistory(ctx, tx, user, slug, models.ActionArchive)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Удаляем сегмент из таблицы сегментов
-	query := `	DELETE FROM segments
+	// Не удаляем сегмент сразу, а переносим в архив вместе с пользователями,
+	// окончательно он будет удален по истечении срока хранения архива
+	query = `	UPDATE segments SET deleted_at = now()
 				WHERE slug = $1`
 
-	_, err = tx.ExecContext(ctx, query, slug)
+	_, err = tx.Exec(ctx, query, slug)
 	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
-func (s *SQLStorage) GetSegmentsByUserID(ctx context.Context, user int64) ([]models.Segment, error) {
+func (s *SQLStorage) RestoreSegment(ctx context.Context, slug string) (err error) {
+	defer func() { err = mapError(err) }()
 
-	segments := make([]models.Segment, 0)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	query := `	SELECT segment_slug FROM users_segments
-				WHERE user_id = $1 AND (expires_at >= NOW() OR expires_at IS NULL)`
-	rows, err := s.db.QueryContext(ctx, query, user)
+	var archived bool
+	query := `SELECT deleted_at IS NOT NULL FROM segments WHERE slug = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, slug).Scan(&archived)
+	if err == pgx.ErrNoRows {
+		return storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Сегмент не в архиве, восстанавливать нечего
+	if !archived {
+		return nil
+	}
+
+	query = `	UPDATE segments SET deleted_at = null
+				WHERE slug = $1`
+	_, err = tx.Exec(ctx, query, slug)
+	if err != nil {
+		return err
+	}
+
+	// Пользователи, у которых сегмент еще не истек, возвращаются в сегмент
+	query = `	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, segment_slug, $2, now() FROM users_segments
+				WHERE segment_slug = $1 AND (expires_at >= now() OR expires_at IS NULL)`
+	_, err = tx.Exec(ctx, query, slug, string(models.ActionRestore))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *SQLStorage) PurgeArchivedSegments(grace time.Duration) {
+
+	ctx := context.Background()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		s.logger.Errorw("error",
+			"PurgeArchivedSegments: starting transaction failed ", err,
+		)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Под той же блокировкой, что и изменения составов, поэтому сегмент не может попасть в состав во время удаления
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, compositionLockKey)
+	if err != nil {
+		s.logger.Errorw("error",
+			"PurgeArchivedSegments: locking compositions failed ", err,
+		)
+		return
+	}
+
+	// Сегмент, который входит в состав другого сегмента, не удаляется, пока его не уберут из состава:
+	// иначе состав изменил бы смысл, например разность лишилась бы уменьшаемого
+	query := `	DELETE FROM segments s
+				WHERE s.deleted_at < now() - $1 * interval '1 second'
+				AND NOT EXISTS (SELECT 1 FROM segments c WHERE s.slug = ANY(c.composite_of))`
+	res, err := tx.Exec(ctx, query, grace.Seconds())
+	if err != nil {
+		s.logger.Errorw("error",
+			"PurgeArchivedSegments: deleting from segments failed ", err,
+		)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		s.logger.Errorw("error",
+			"PurgeArchivedSegments: committing transaction failed ", err,
+		)
+		return
+	}
+
+	purged := res.RowsAffected()
+	s.logger.Infow("info",
+		"PurgeArchivedSegments: successfully purged segments: ", purged,
+	)
+}
+
+func (s *SQLStorage) RenameSegment(ctx context.Context, slug string, newSlug string) (err error) {
+	defer func() { err = mapError(err) }()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Переименование меняет составы других сегментов, поэтому сериализуется с изменением составов
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, compositionLockKey)
+	if err != nil {
+		return err
+	}
+
+	// Блокируем переименовываемый сегмент до конца транзакции, архивные сегменты не переименовываем
+	query := `SELECT slug FROM segments WHERE slug = $1 AND deleted_at IS NULL FOR UPDATE`
+	err = tx.QueryRow(ctx, query, slug).Scan(&slug)
+	if err == pgx.ErrNoRows {
+		return storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Создаем сегмент с новым названием, тем же описанием, правилом и составом, если новое название свободно
+	query = `	INSERT INTO segments (slug, description, owner, tags, attributes, rule, materialized, rule_dirty, composite_op, composite_of, created_at, updated_at)
+				SELECT $2, description, owner, tags, attributes, rule, materialized, rule_dirty, composite_op, composite_of, created_at, now() FROM segments
+				WHERE slug = $1
+				ON CONFLICT (slug) DO NOTHING`
+	res, err := tx.Exec(ctx, query, slug, newSlug)
+	if err != nil {
+		return err
+	}
+	created := res.RowsAffected()
+	if created == 0 {
+		return storage.ErrSegmentExists
+	}
+
+	// Переносим пользователей в сегмент с новым названием и пишем о переименовании в историю
+	query = `	UPDATE users_segments SET segment_slug = $2
+				WHERE segment_slug = $1`
+	_, err = tx.Exec(ctx, query, slug, newSlug)
+	if err != nil {
+		return err
+	}
+
+	query = `	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+				SELECT user_id, segment_slug, $2, now() FROM users_segments
+				WHERE segment_slug = $1`
+	_, err = tx.Exec(ctx, query, newSlug, string(models.ActionRename))
+	if err != nil {
+		return err
+	}
+
+	// Старое название и все прежние названия сегмента становятся псевдонимами нового,
+	// если новое название раньше было псевдонимом, то теперь это снова настоящий сегмент
+	query = `	UPDATE segment_aliases SET slug = $2
+				WHERE slug = $1`
+	_, err = tx.Exec(ctx, query, slug, newSlug)
+	if err != nil {
+		return err
+	}
+
+	query = `	DELETE FROM segment_aliases
+				WHERE alias = $1`
+	_, err = tx.Exec(ctx, query, newSlug)
+	if err != nil {
+		return err
+	}
+
+	query = `	INSERT INTO segment_aliases (alias, slug, renamed_at)
+				VALUES ($1, $2, now())
+				ON CONFLICT (alias) DO UPDATE
+				SET slug = EXCLUDED.slug, renamed_at = EXCLUDED.renamed_at`
+	_, err = tx.Exec(ctx, query, slug, newSlug)
+	if err != nil {
+		return err
+	}
+
+	// Составные сегменты ссылаются на сегмент по новому названию
+	query = `	UPDATE segments SET composite_of = array_replace(composite_of, $1, $2)
+				WHERE $1 = ANY(composite_of)`
+	_, err = tx.Exec(ctx, query, slug, newSlug)
+	if err != nil {
+		return err
+	}
+
+	query = `	DELETE FROM segments
+				WHERE slug = $1`
+	_, err = tx.Exec(ctx, query, slug)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *SQLStorage) GetSegmentsByUserID(ctx context.Context, user int64) (_ []models.Segment, err error) {
+	defer func() { err = mapError(err) }()
+
+	segments, err := s.getUserSegments(ctx, s.pool, user)
 	if err != nil {
 		return nil, err
 	}
 
-	for rows.Next() {
-		var segment models.Segment
-		err = rows.Scan(&segment.Slug)
+	// Пустой список может означать, что такого пользователя нет вовсе
+	if len(segments) == 0 {
+		var exists bool
+		query := `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`
+		err = s.pool.QueryRow(ctx, query, user).Scan(&exists)
 		if err != nil {
 			return nil, err
 		}
-		segments = append(segments, segment)
-	}
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+		if !exists {
+			return nil, storage.ErrUserNotFound
+		}
 	}
 
 	s.logger.Infow("info",
@@ -194,49 +532,146 @@ func (s *SQLStorage) GetSegmentsByUserID(ctx context.Context, user int64) ([]mod
 	return segments, nil
 }
 
-func (s *SQLStorage) UpdateSegmentsByUserID(ctx context.Context, user int64, deleteList []models.Segment, addList []models.Segment) error {
+func (s *SQLStorage) GetSegmentsByUserIDs(ctx context.Context, users []int64) (_ map[int64][]models.Segment, err error) {
+	defer func() { err = mapError(err) }()
 
-	tx, err := s.db.Begin()
+	segments, err := s.getUsersSegments(ctx, s.pool, users)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Пользователи без активных сегментов и неизвестные пользователи получают пустой список
+	for _, user := range users {
+		if _, ok := segments[user]; !ok {
+			segments[user] = make([]models.Segment, 0)
+		}
+	}
+	return segments, nil
+}
+
+func (s *SQLStorage) GetMembership(ctx context.Context, user int64, slug string) (_ models.Membership, err error) {
+	defer func() { err = mapError(err) }()
+
+	membership := models.Membership{User: user, Slug: slug}
+
+	// Поиск идет по уникальному индексу (user_id, segment_slug), учитываются только активные сегменты.
+	// Членство в составном сегменте только вычисляется, поэтому хранимые строки по нему не учитываются
+	query := `	SELECT us.expires_at, us.joined_at FROM users_segments us
+				JOIN segments s ON s.slug = us.segment_slug AND s.deleted_at IS NULL AND s.composite_op IS NULL
+				WHERE us.user_id = $1 AND us.segment_slug = $2 AND (us.expires_at >= NOW() OR us.expires_at IS NULL)`
+	err = s.pool.QueryRow(ctx, query, user, slug).Scan(&membership.ExpiresAt, &membership.JoinedAt)
+	if err == nil {
+		membership.Member = true
+		return membership, nil
+	}
+	if err != pgx.ErrNoRows {
+		return membership, err
+	}
+
+	// Пользователь не в сегменте, проверяем, что сегмент и пользователь вообще существуют
+	var segmentExists, userExists bool
+	query = `SELECT EXISTS (SELECT 1 FROM segments WHERE slug = $2 AND deleted_at IS NULL), EXISTS (SELECT 1 FROM users WHERE id = $1)`
+	err = s.pool.QueryRow(ctx, query, user, slug).Scan(&segmentExists, &userExists)
+	if err != nil {
+		return membership, err
+	}
+	if !segmentExists {
+		return membership, storage.ErrSegmentNotFound
+	}
+	if !userExists {
+		return membership, storage.ErrUserNotFound
+	}
+
+	// Пользователь может состоять в составном сегменте, который вычисляется из остальных его сегментов
+	var composite bool
+	query = `SELECT composite_op IS NOT NULL FROM segments WHERE slug = $1 AND deleted_at IS NULL`
+	err = s.pool.QueryRow(ctx, query, slug).Scan(&composite)
+	if err != nil && err != pgx.ErrNoRows {
+		return membership, err
+	}
+	if composite {
+		segments, err := s.getUserSegments(ctx, s.pool, user)
+		if err != nil {
+			return membership, err
+		}
+		membership.Member = containsSegment(segments, slug)
+		return membership, nil
+	}
+
+	// Пользователь может состоять в сегменте по правилу, которое вычисляется при чтении
+	var (
+		rule       string
+		attributes map[string]any
+	)
+	query = `	SELECT s.rule, u.attributes FROM segments s, users u
+				WHERE s.slug = $2 AND s.deleted_at IS NULL AND s.rule IS NOT NULL AND NOT s.materialized AND u.id = $1`
+	err = s.pool.QueryRow(ctx, query, user, slug).Scan(&rule, &attributes)
+	if err == pgx.ErrNoRows {
+		return membership, nil
+	}
+	if err != nil {
+		return membership, err
+	}
+	if parsed := s.parseRule(slug, rule); parsed != nil {
+		membership.Member = parsed.Match(attributes)
+	}
+	return membership, nil
+}
+
+func (s *SQLStorage) UpdateSegmentsByUserID(ctx context.Context, user int64, deleteList []models.Segment, addList []models.Segment, strict bool) (_ models.UpdateResult, err error) {
+	defer func() { err = mapError(err) }()
+
+	result := models.UpdateResult{
+		Added:      make([]models.Segment, 0),
+		TTLUpdated: make([]models.Segment, 0),
+		Removed:    make([]models.Segment, 0),
+		Ignored:    make([]models.Segment, 0),
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(ctx)
+
+	// В строгом режиме добавлять можно только в уже существующие сегменты
+	if strict {
+		err = s.checkSegmentsExist(ctx, tx, addList)
+		if err != nil {
+			return result, err
+		}
 	}
-	defer tx.Rollback()
 
 	// Добавляем пользователя, если его не существует
 	query := ` 	INSERT INTO users (id) VALUES ($1)
      			ON CONFLICT (id) DO NOTHING`
 
-	_, err = tx.ExecContext(ctx, query, user)
+	_, err = tx.Exec(ctx, query, user)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	// Удаляем сегмент, если пользователь находится в нем и вносим удаление в историю
 	for _, segment := range deleteList {
 
-		ok, err := s.checkUserInSegment(ctx, user, segment.Slug)
-		if err != nil {
-			return err
-		}
-
-		if !ok {
-			continue
-		}
-
 		query = ` 	DELETE FROM users_segments
    					WHERE user_id = $1 AND segment_slug = $2`
-		_, err = tx.ExecContext(ctx, query, user, segment.Slug)
+		res, err := tx.Exec(ctx, query, user, segment.Slug)
 		if err != nil {
-			return err
+			return result, err
 		}
 
-		query = ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
-    				VALUES ($1, $2, false, now())`
+		deleted := res.RowsAffected()
+		if deleted == 0 {
+			result.Ignored = append(result.Ignored, models.Segment{Slug: segment.Slug})
+			continue
+		}
 
-		_, err = tx.ExecContext(ctx, query, user, segment.Slug)
+		err = s.addHistory(ctx, tx, user, segment.Slug, models.ActionRemove)
 		if err != nil {
-			return err
+			return result, err
 		}
+		result.Removed = append(result.Removed, models.Segment{Slug: segment.Slug})
 	}
 
 	for _, segment := range addList {
@@ -245,70 +680,144 @@ func (s *SQLStorage) UpdateSegmentsByUserID(ctx context.Context, user int64, del
 		query := ` 	INSERT INTO segments (slug) VALUES ($1)
      			    ON CONFLICT (slug) DO NOTHING`
 
-		_, err = tx.ExecContext(ctx, query, segment.Slug)
+		_, err = tx.Exec(ctx, query, segment.Slug)
 		if err != nil {
-			return err
+			return result, err
+		}
+
+		err = s.checkSegmentAcceptsUsers(ctx, tx, segment.Slug)
+		if err != nil {
+			return result, err
+		}
+
+		membership, err := s.lockMembership(ctx, tx, user, segment.Slug)
+		if err != nil {
+			return result, err
+		}
+
+		// Пользователь уже в сегменте без TTL и TTL не передан - ничего не меняется, в историю не пишем
+		if membership.exists && !membership.expired && membership.expiresAt == nil && segment.DaysTTL == 0 {
+			continue
 		}
 
-		// Если указан TTL, тогда вычисляем время, когда сегмент должен перестать быть валидным и обновляем в expires_at
-		if segment.DaysTTL != 0 {
-			query = ` 	INSERT INTO users_segments (user_id, segment_slug, expires_at)
-						VALUES ($1, $2, now() + interval '1 day' * $3)
-						ON CONFLICT (user_id, segment_slug) DO UPDATE
-						SET expires_at = EXCLUDED.expires_at`
-			_, err = tx.ExecContext(ctx, query, user, segment.Slug, segment.DaysTTL)
+		// Если сегмент уже истек, но еще не был удален фоновой задачей, то фиксируем удаление по TTL
+		if membership.expired {
+			err = s.addHistory(ctx, tx, user, segment.Slug, models.ActionRemove)
 			if err != nil {
-				return err
+				return result, err
 			}
-			// Иначе считаем, что пользователя необходимо добавить в сегмент перманентно (обозначается NULL)
-		} else {
-			query = ` 	INSERT INTO users_segments (user_id, segment_slug, expires_at)
-						VALUES ($1, $2, null)
-						ON CONFLICT (user_id, segment_slug) DO UPDATE
-						SET expires_at = EXCLUDED.expires_at`
-			_, err = tx.ExecContext(ctx, query, user, segment.Slug)
+		}
+
+		// Если указан TTL, тогда вычисляем время, когда сегмент должен перестать быть валидным и обновляем в expires_at,
+		// иначе считаем, что пользователя необходимо добавить в сегмент перманентно (обозначается NULL)
+		query = ` 	INSERT INTO users_segments (user_id, segment_slug, expires_at)
+					VALUES ($1, $2, CASE WHEN $3::integer = 0 THEN null ELSE now() + interval '1 day' * $3 END)
+					ON CONFLICT (user_id, segment_slug) DO UPDATE
+					SET expires_at = EXCLUDED.expires_at,
+						joined_at = CASE WHEN users_segments.expires_at < now() THEN now() ELSE users_segments.joined_at END,
+						reason = NULL`
+		_, err = tx.Exec(ctx, query, user, segment.Slug, segment.DaysTTL)
+		if err != nil {
+			return result, err
+		}
+
+		// Пишем в историю либо о добавлении, либо об изменении TTL
+		if membership.exists && !membership.expired {
+			err = s.addHistory(ctx, tx, user, segment.Slug, models.ActionTTLUpdate)
 			if err != nil {
-				return err
+				return result, err
 			}
+			result.TTLUpdated = append(result.TTLUpdated, segment)
+			continue
 		}
 
-		// Пишем о добавлении в историю
-		query = ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
-    				VALUES ($1, $2, true, now())`
-		_, err = tx.ExecContext(ctx, query, user, segment.Slug)
+		err = s.addHistory(ctx, tx, user, segment.Slug, models.ActionAdd)
 		if err != nil {
-			return err
+			return result, err
 		}
+		result.Added = append(result.Added, segment)
+	}
+
+	// Получаем итоговый список сегментов пользователя внутри той же транзакции
+	result.Segments, err = s.getUserSegments(ctx, tx, user)
+	if err != nil {
+		return result, err
 	}
-	return tx.Commit()
+	return result, tx.Commit(ctx)
 }
 
-func (s *SQLStorage) GetHistory(ctx context.Context, users []int64, days int) ([]models.History, error) {
+func (s *SQLStorage) GetHistory(ctx context.Context, filter models.HistoryFilter) (_ []models.History, err error) {
+	defer func() { err = mapError(err) }()
 
 	usersHistory := make([]models.History, 0)
 
-	for _, user := range users {
-		query := `	SELECT segment_slug, user_id, action, action_time 
-					FROM segments_history
-					WHERE user_id = $1 AND action_time >= NOW() - interval '1 day' * $2;`
+	// История сегментов ищется и по текущему, и по всем прежним названиям
+	segments, err := s.resolveSegmentNames(ctx, filter.Segments)
+	if err != nil {
+		return nil, err
+	}
 
-		rows, err := s.db.QueryContext(ctx, query, user, days)
+	// По запросу к истории добавляются записи из таблицы архива, идентификаторы нужны,
+	// чтобы не выводить дважды записи, которые попали и в историю, и в архивные файлы
+	seen := make(map[int64]bool)
+	for _, user := range filter.Users {
+		query := `	SELECT id, segment_slug, user_id, action, action_time, coalesce(reason, '')
+					FROM segments_history
+					WHERE user_id = $1 AND action_time >= NOW() - interval '1 day' * $2
+					AND (cardinality($3::text[]) = 0 OR segment_slug = ANY($3))
+					UNION ALL
+					SELECT id, segment_slug, user_id, action, action_time, coalesce(reason, '')
+					FROM segments_history_archive
+					WHERE $4 AND user_id = $1 AND action_time >= NOW() - interval '1 day' * $2
+					AND (cardinality($3::text[]) = 0 OR segment_slug = ANY($3))`
+
+		rows, err := s.pool.Query(ctx, query, user, filter.Days, segments, filter.IncludeArchive)
+		if err != nil {
+			return nil, err
+		}
 
 		for rows.Next() {
-			var history models.History
-			err = rows.Scan(&history.Segment.Slug, &history.User, &history.Action, &history.ActionTime)
+			var (
+				id         int64
+				history    models.History
+				actionTime time.Time
+			)
+			err = rows.Scan(&id, &history.Segment.Slug, &history.User, &history.Action, &actionTime, &history.Reason)
 			if err != nil {
+				rows.Close()
 				return nil, err
 			}
+
+			// pgx не переводит время в строку при сканировании, поэтому форматируем так же, как database/sql
+			history.ActionTime = actionTime.Format(time.RFC3339Nano)
 			usersHistory = append(usersHistory, history)
+			seen[id] = true
 		}
 		err = rows.Err()
+		rows.Close()
 		if err != nil {
 			return nil, err
 		}
 
 	}
-	return usersHistory, nil
+
+	if !filter.IncludeArchive {
+		return usersHistory, nil
+	}
+
+	// Начало периода вычисляем в базе данных, так как action_time записано по ее часам
+	var since time.Time
+	query := `SELECT (NOW() - interval '1 day' * $1)::timestamp`
+	err = s.pool.QueryRow(ctx, query, filter.Days).Scan(&since)
+	if err != nil {
+		return nil, err
+	}
+
+	archived, err := s.readArchiveFiles(filter.Users, segments, since, seen)
+	if err != nil {
+		return nil, err
+	}
+	return append(usersHistory, archived...), nil
 }
 
 type expiredSegment struct {
@@ -316,28 +825,33 @@ type expiredSegment struct {
 	slug string
 }
 
-func (s *SQLStorage) DeleteExpiredSegments() {
-	tx, err := s.db.Begin()
+// DeleteExpiredSegments возвращает пользователей, у которых были удалены истекшие сегменты
+func (s *SQLStorage) DeleteExpiredSegments() []int64 {
+
+	ctx := context.Background()
+
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		s.logger.Errorw("error",
 			"DeleteExpiredSegments: transaction failed: ", err,
 		)
-		return
+		return nil
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	// Найдем все не валидные более для пользователей сегменты
 	expiredSegments := make([]expiredSegment, 0)
 
 	query := `	SELECT user_id, segment_slug FROM users_segments
 				WHERE  expires_at < now()`
-	rows, err := s.db.QueryContext(context.Background(), query)
+	rows, err := tx.Query(ctx, query)
 	if err != nil {
 		s.logger.Errorw("error",
 			"DeleteExpiredSegments: selection from users_segments failed ", err,
 		)
-		return
+		return nil
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var segment expiredSegment
@@ -346,7 +860,7 @@ func (s *SQLStorage) DeleteExpiredSegments() {
 			s.logger.Errorw("error",
 				"DeleteExpiredSegments: enumerating users_segments failed ", err,
 			)
-			return
+			return nil
 		}
 		expiredSegments = append(expiredSegments, segment)
 	}
@@ -355,34 +869,139 @@ func (s *SQLStorage) DeleteExpiredSegments() {
 		s.logger.Errorw("error",
 			"DeleteExpiredSegments: enumerating users_segments err failed ", err,
 		)
-		return
+		return nil
 	}
 
 	// Пишем об удалении сегмента в историю и удаляем
 	for _, segment := range expiredSegments {
-		query = ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
-    				VALUES ($1, $2, false, now())`
-		_, err = tx.ExecContext(context.Background(), query, segment.user, segment.slug)
+		err = s.addHistory(ctx, tx, segment.user, segment.slug, models.ActionRemove)
 		if err != nil {
 			s.logger.Errorw("error",
 				"DeleteExpiredSegments: inserting into segments_history failed ", err,
 			)
-			return
+			return nil
 		}
 
 		query = ` 	DELETE FROM users_segments
    					WHERE user_id = $1 AND segment_slug = $2`
-		_, err = tx.ExecContext(context.Background(), query, segment.user, segment.slug)
+		_, err = tx.Exec(ctx, query, segment.user, segment.slug)
 		if err != nil {
 			s.logger.Errorw("error",
 				"DeleteExpiredSegments: deleting from segments_history failed ", err,
 			)
 		}
 	}
+
+	// Пользователь, у которого истекло ручное членство в материализованном сегменте с правилом,
+	// может по-прежнему подходить под правило, поэтому ставим его в очередь пересчета
+	users := make([]int64, 0, len(expiredSegments))
+	slugs := make([]string, 0, len(expiredSegments))
+	for _, segment := range expiredSegments {
+		users = append(users, segment.user)
+		slugs = append(slugs, segment.slug)
+	}
+	query = `	INSERT INTO rule_queue (user_id, queued_at)
+				SELECT DISTINCT e.user_id, now() FROM unnest($1::bigint[], $2::text[]) AS e(user_id, slug)
+				JOIN segments s ON s.slug = e.slug AND s.rule IS NOT NULL AND s.materialized AND s.deleted_at IS NULL
+				ON CONFLICT (user_id) DO NOTHING`
+	_, err = tx.Exec(ctx, query, users, slugs)
+	if err != nil {
+		s.logger.Errorw("error",
+			"DeleteExpiredSegments: inserting into rule_queue failed ", err,
+		)
+		return nil
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		s.logger.Errorw("error",
+			"DeleteExpiredSegments: commit failed ", err,
+		)
+		return nil
+	}
 	s.logger.Infow("info",
 		"DeleteExpiredSegments: successfully deleted segments: ", expiredSegments,
 	)
-	tx.Commit()
+
+	changed := make([]int64, 0, len(expiredSegments))
+	seen := make(map[int64]bool, len(expiredSegments))
+	for _, segment := range expiredSegments {
+		if !seen[segment.user] {
+			seen[segment.user] = true
+			changed = append(changed, segment.user)
+		}
+	}
+	return changed
+}
+
+func (s *SQLStorage) ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (_ models.IdempotencyRecord, _ bool, err error) {
+	defer func() { err = mapError(err) }()
+
+	// Резервируем ключ, если его нет или срок хранения предыдущего ответа истек
+	query := ` 	INSERT INTO idempotency_keys (key, request_hash, status_code, body, expires_at)
+				VALUES ($1, $2, null, null, $3)
+				ON CONFLICT (key) DO UPDATE
+				SET request_hash = EXCLUDED.request_hash, status_code = null, body = null, expires_at = EXCLUDED.expires_at
+				WHERE idempotency_keys.expires_at < now()`
+	res, err := s.pool.Exec(ctx, query, record.Key, record.RequestHash, record.ExpiresAt)
+	if err != nil {
+		return models.IdempotencyRecord{}, false, err
+	}
+
+	reserved := res.RowsAffected()
+	if reserved == 1 {
+		return record, true, nil
+	}
+
+	// Ключ уже занят, возвращаем сохраненную запись
+	var (
+		stored     models.IdempotencyRecord
+		statusCode *int
+	)
+	query = `	SELECT key, request_hash, status_code, body, expires_at FROM idempotency_keys
+				WHERE key = $1`
+	err = s.pool.QueryRow(ctx, query, record.Key).Scan(&stored.Key, &stored.RequestHash, &statusCode, &stored.Body, &stored.ExpiresAt)
+	if err != nil {
+		return models.IdempotencyRecord{}, false, err
+	}
+	if statusCode != nil {
+		stored.StatusCode = *statusCode
+	}
+	return stored, false, nil
+}
+
+func (s *SQLStorage) SaveIdempotencyResponse(ctx context.Context, key string, statusCode int, body []byte) (err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `	UPDATE idempotency_keys SET status_code = $2, body = $3
+				WHERE key = $1`
+	_, err = s.pool.Exec(ctx, query, key, statusCode, body)
+	return err
+}
+
+func (s *SQLStorage) DeleteIdempotencyKey(ctx context.Context, key string) (err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `DELETE FROM idempotency_keys WHERE key = $1`
+	_, err = s.pool.Exec(ctx, query, key)
+	return err
+}
+
+func (s *SQLStorage) DeleteExpiredIdempotencyKeys() {
+
+	query := `DELETE FROM idempotency_keys WHERE expires_at < now()`
+	res, err := s.pool.Exec(context.Background(), query)
+	if err != nil {
+		s.logger.Errorw("error",
+			"DeleteExpiredIdempotencyKeys: deleting from idempotency_keys failed ", err,
+		)
+		return
+	}
+
+	deleted := res.RowsAffected()
+	s.logger.Infow("info",
+		"DeleteExpiredIdempotencyKeys: successfully deleted keys: ", deleted,
+	)
 }
 
 func (s *SQLStorage) getRandomUsers(ctx context.Context, percentage int) ([]int64, error) {
@@ -390,7 +1009,7 @@ func (s *SQLStorage) getRandomUsers(ctx context.Context, percentage int) ([]int6
 	usersRND := make([]int64, 0)
 
 	query := `SELECT id FROM users TABLESAMPLE BERNOULLI ($1)`
-	rows, err := s.db.QueryContext(ctx, query, percentage)
+	rows, err := s.pool.Query(ctx, query, percentage)
 	if err != nil {
 		return nil, err
 	}
@@ -416,7 +1035,7 @@ func (s *SQLStorage) getUsersInSegment(ctx context.Context, slug string) ([]int6
 	users := make([]int64, 0)
 
 	query := `SELECT user_id FROM users_segments WHERE segment_slug = $1`
-	rows, err := s.db.QueryContext(ctx, query, slug)
+	rows, err := s.pool.Query(ctx, query, slug)
 	if err != nil {
 		return nil, err
 	}
@@ -437,18 +1056,277 @@ func (s *SQLStorage) getUsersInSegment(ctx context.Context, slug string) ([]int6
 	return users, nil
 }
 
-func (s *SQLStorage) checkUserInSegment(ctx context.Context, user int64, slug string) (bool, error) {
+// Проверяем, что все сегменты существуют, и блокируем их от удаления до конца транзакции
+func (s *SQLStorage) checkSegmentsExist(ctx context.Context, tx pgx.Tx, segments []models.Segment) error {
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	slugs := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		slugs = append(slugs, segment.Slug)
+	}
+
+	query := `	SELECT slug FROM segments
+				WHERE slug = ANY($1)
+				FOR SHARE`
+	rows, err := tx.Query(ctx, query, slugs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		err = rows.Scan(&slug)
+		if err != nil {
+			return err
+		}
+		existing[slug] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	unknown := make([]string, 0)
+	for _, slug := range slugs {
+		if !existing[slug] {
+			unknown = append(unknown, slug)
+			existing[slug] = true
+		}
+	}
+	if len(unknown) != 0 {
+		return &storage.UnknownSegmentsError{Slugs: unknown}
+	}
+	return nil
+}
+
+const segmentInfoColumns = `slug, description, owner, tags, attributes, coalesce(rule, ''), materialized, coalesce(composite_op, ''), composite_of, created_at, updated_at, deleted_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSegmentInfo(row rowScanner) (models.SegmentInfo, error) {
+
+	var (
+		segment     models.SegmentInfo
+		attributes  []byte
+		compositeOp string
+		compositeOf []string
+	)
+	err := row.Scan(&segment.Slug, &segment.Description, &segment.Owner, &segment.Tags, &attributes, &segment.Rule, &segment.Materialized, &compositeOp, &compositeOf, &segment.CreatedAt, &segment.UpdatedAt, &segment.DeletedAt)
+	if err != nil {
+		return segment, err
+	}
+
+	if compositeOp != "" {
+		segment.Composition = &models.Composition{Operation: models.SetOperation(compositeOp), Segments: compositeOf}
+	}
+
+	segment.Tags = tagsOrEmpty(segment.Tags)
+	segment.Attributes = attributes
+	return segment, nil
+}
+
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
 
-	query := ` 	SELECT user_id FROM users_segments
-   				WHERE user_id = $1 AND segment_slug = $2`
+func attributesOrNull(attributes json.RawMessage) any {
+	if len(attributes) == 0 {
+		return nil
+	}
+	return string(attributes)
+}
+
+// Для каждого названия находим текущее название сегмента и все его псевдонимы
+func (s *SQLStorage) resolveSegmentNames(ctx context.Context, slugs []string) ([]string, error) {
 
-	var userID int
-	err := s.db.QueryRowContext(ctx, query, user, slug).Scan(&userID)
-	if err == sql.ErrNoRows {
-		return false, nil
+	names := make([]string, 0)
+	if len(slugs) == 0 {
+		return names, nil
 	}
+
+	query := `	WITH canonical AS (
+					SELECT coalesce(a.slug, requested.slug) AS slug
+					FROM unnest($1::text[]) AS requested(slug)
+					LEFT JOIN segment_aliases a ON a.alias = requested.slug
+				)
+				SELECT slug FROM canonical
+				UNION
+				SELECT a.alias FROM segment_aliases a JOIN canonical c ON a.slug = c.slug
+				UNION
+				SELECT unnest($1::text[])`
+	rows, err := s.pool.Query(ctx, query, slugs)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return true, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Проверяем, что сегмент не находится в архиве, и блокируем его от архивирования до конца транзакции
+func (s *SQLStorage) checkSegmentActive(ctx context.Context, tx pgx.Tx, slug string) error {
+
+	var archived bool
+	query := `SELECT deleted_at IS NOT NULL FROM segments WHERE slug = $1 FOR SHARE`
+	err := tx.QueryRow(ctx, query, slug).Scan(&archived)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return fmt.Errorf("%w: %s", storage.ErrSegmentArchived, slug)
+	}
+	return nil
+}
+
+// Пользователей можно явно добавлять только в активный сегмент без состава. Сегмент блокируется
+// от архивирования и изменения состава до конца транзакции
+func (s *SQLStorage) checkSegmentAcceptsUsers(ctx context.Context, tx pgx.Tx, slug string) error {
+
+	var archived, composite bool
+	query := `SELECT deleted_at IS NOT NULL, composite_op IS NOT NULL FROM segments WHERE slug = $1 FOR SHARE`
+	err := tx.QueryRow(ctx, query, slug).Scan(&archived, &composite)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return fmt.Errorf("%w: %s", storage.ErrSegmentArchived, slug)
+	}
+	if composite {
+		return &storage.CompositeSegmentsError{Slugs: []string{slug}}
+	}
+	return nil
+}
+
+type querier interface {
+	Query(ctx context.Context, query string, args ...any) (pgx.Rows, error)
+}
+
+func (s *SQLStorage) getUserSegments(ctx context.Context, q querier, user int64) ([]models.Segment, error) {
+
+	segments := make([]models.Segment, 0)
+
+	query := `	SELECT us.segment_slug, us.expires_at FROM users_segments us
+				JOIN segments s ON s.slug = us.segment_slug AND s.deleted_at IS NULL
+				WHERE us.user_id = $1 AND (us.expires_at >= NOW() OR us.expires_at IS NULL)
+				ORDER BY us.segment_slug`
+	rows, err := q.Query(ctx, query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var segment models.Segment
+		err = rows.Scan(&segment.Slug, &segment.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	withRules, err := s.addRuleSegments(ctx, q, map[int64][]models.Segment{user: segments}, []int64{user})
+	if err != nil {
+		return nil, err
+	}
+	withComposites, err := addCompositeSegments(ctx, q, withRules)
+	if err != nil {
+		return nil, err
+	}
+	return withComposites[user], nil
+}
+
+// То же, что getUserSegments, но для многих пользователей одним запросом
+func (s *SQLStorage) getUsersSegments(ctx context.Context, q querier, users []int64) (map[int64][]models.Segment, error) {
+
+	segments := make(map[int64][]models.Segment)
+
+	query := `	SELECT us.user_id, us.segment_slug, us.expires_at FROM users_segments us
+				JOIN segments s ON s.slug = us.segment_slug AND s.deleted_at IS NULL
+				WHERE us.user_id = ANY($1::bigint[]) AND (us.expires_at >= NOW() OR us.expires_at IS NULL)
+				ORDER BY us.user_id, us.segment_slug`
+	rows, err := q.Query(ctx, query, users)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			user    int64
+			segment models.Segment
+		)
+		err = rows.Scan(&user, &segment.Slug, &segment.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		segments[user] = append(segments[user], segment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	withRules, err := s.addRuleSegments(ctx, q, segments, users)
+	if err != nil {
+		return nil, err
+	}
+	return addCompositeSegments(ctx, q, withRules)
+}
+
+type membership struct {
+	exists    bool
+	expired   bool
+	expiresAt *time.Time
+}
+
+// Блокируем строку членства пользователя в сегменте до конца транзакции и узнаем ее текущее состояние
+func (s *SQLStorage) lockMembership(ctx context.Context, tx pgx.Tx, user int64, slug string) (membership, error) {
+
+	var m membership
+
+	query := ` 	SELECT expires_at, coalesce(expires_at < now(), false) FROM users_segments
+   				WHERE user_id = $1 AND segment_slug = $2
+				FOR UPDATE`
+	err := tx.QueryRow(ctx, query, user, slug).Scan(&m.expiresAt, &m.expired)
+	if err == pgx.ErrNoRows {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	m.exists = true
+	return m, nil
+}
+
+func (s *SQLStorage) addHistory(ctx context.Context, tx pgx.Tx, user int64, slug string, action models.Action) error {
+
+	query := ` 	INSERT INTO segments_history (user_id, segment_slug, action, action_time)
+    			VALUES ($1, $2, $3, now())`
+	_, err := tx.Exec(ctx, query, user, slug, string(action))
+	return err
 }
@@ -0,0 +1,240 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/storage"
+)
+
+const userColumns = `id, created_at, attributes`
+
+// CreateUser регистрирует пользователя с атрибутами, если его еще нет, и возвращает его вместе с признаком регистрации.
+// Атрибуты уже зарегистрированного пользователя не меняются
+func (s *SQLStorage) CreateUser(ctx context.Context, user int64, attributes json.RawMessage) (_ models.CreateUserResult, err error) {
+	defer func() { err = mapError(err) }()
+
+	var result models.CreateUserResult
+
+	query := `	INSERT INTO users (id, created_at, attributes) VALUES ($1, now(), coalesce($2::jsonb, '{}'))
+				ON CONFLICT (id) DO NOTHING
+				RETURNING ` + userColumns
+	result.User, err = scanUser(s.pool.QueryRow(ctx, query, user, attributesOrNull(attributes)))
+	if err == nil {
+		result.Created = true
+		return result, nil
+	}
+	if err != pgx.ErrNoRows {
+		return result, err
+	}
+
+	// Пользователь уже зарегистрирован явно или неявно при добавлении в сегменты
+	result.User, err = s.GetUser(ctx, user)
+	return result, err
+}
+
+// ImportUsers регистрирует всех еще не зарегистрированных пользователей из списка одним запросом
+func (s *SQLStorage) ImportUsers(ctx context.Context, users []int64) (_ models.UserImportResult, err error) {
+	defer func() { err = mapError(err) }()
+
+	var result models.UserImportResult
+
+	unique := make(map[int64]bool, len(users))
+	for _, user := range users {
+		unique[user] = true
+	}
+
+	query := `	INSERT INTO users (id, created_at)
+				SELECT DISTINCT unnest($1::bigint[]), now()
+				ON CONFLICT (id) DO NOTHING`
+	tag, err := s.pool.Exec(ctx, query, users)
+	if err != nil {
+		return result, err
+	}
+
+	result.Registered = tag.RowsAffected()
+	result.Existing = int64(len(unique)) - result.Registered
+
+	s.logger.Infow("info",
+		"ImportUsers: successfully registered users: ", result.Registered,
+	)
+	return result, nil
+}
+
+// UpdateUserAttributes заменяет атрибуты пользователя или, если merge, дописывает переданные атрибуты
+// к текущим, при этом атрибуты со значением null удаляются. Неизвестный пользователь регистрируется
+func (s *SQLStorage) UpdateUserAttributes(ctx context.Context, user int64, attributes json.RawMessage, merge bool) (_ models.User, err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `	INSERT INTO users (id, created_at, attributes) VALUES ($1, now(), jsonb_strip_nulls($2::jsonb))
+				ON CONFLICT (id) DO UPDATE
+				SET attributes = CASE WHEN $3 THEN jsonb_strip_nulls(users.attributes || $2::jsonb) ELSE jsonb_strip_nulls($2::jsonb) END
+				RETURNING ` + userColumns
+	result, err := scanUser(s.pool.QueryRow(ctx, query, user, string(attributes), merge))
+	if err != nil {
+		return result, err
+	}
+
+	s.logger.Infow("info",
+		"UpdateUserAttributes: successfully updated attributes of user: ", user,
+	)
+	return result, nil
+}
+
+func (s *SQLStorage) GetUser(ctx context.Context, user int64) (_ models.User, err error) {
+	defer func() { err = mapError(err) }()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	result, err := scanUser(s.pool.QueryRow(ctx, query, user))
+	if err == pgx.ErrNoRows {
+		return result, storage.ErrUserNotFound
+	}
+	return result, err
+}
+
+// GetUsers возвращает не больше limit пользователей с идентификаторами больше after по возрастанию идентификатора,
+// поэтому следующая страница запрашивается с последним идентификатором предыдущей
+func (s *SQLStorage) GetUsers(ctx context.Context, after int64, limit int) (_ []models.User, err error) {
+	defer func() { err = mapError(err) }()
+
+	users := make([]models.User, 0)
+
+	query := `	SELECT ` + userColumns + ` FROM users
+				WHERE id > $1
+				ORDER BY id
+				LIMIT $2`
+	rows, err := s.pool.Query(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// DeleteUser удаляет пользователя вместе с членством в сегментах, обезличивает или удаляет его историю
+// в основной таблице и в таблице архива и записывает удаление в журнал аудита, все в одной транзакции.
+// В той же транзакции удаление ставится в очередь archive_erasures, а архивные файлы истории переписываются
+// по той же политике уже после фиксации. Если переписать файлы не удалось, то это повторит фоновая задача архивирования
+func (s *SQLStorage) DeleteUser(ctx context.Context, user int64, policy models.ErasurePolicy) (_ models.UserErasure, err error) {
+	defer func() { err = mapError(err) }()
+
+	erasure := models.UserErasure{User: user, Policy: policy}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return erasure, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `DELETE FROM users_segments WHERE user_id = $1`
+	tag, err := tx.Exec(ctx, query, user)
+	if err != nil {
+		return erasure, err
+	}
+	erasure.MembershipsRemoved = tag.RowsAffected()
+
+	query = `DELETE FROM users WHERE id = $1`
+	tag, err = tx.Exec(ctx, query, user)
+	if err != nil {
+		return erasure, err
+	}
+	found := tag.RowsAffected() != 0
+
+	// Удаленный пользователь больше не должен пересчитываться по правилам
+	query = `DELETE FROM rule_queue WHERE user_id = $1`
+	_, err = tx.Exec(ctx, query, user)
+	if err != nil {
+		return erasure, err
+	}
+
+	var queries []string
+	switch policy {
+	case models.ErasureAnonymize:
+		queries = []string{
+			`UPDATE segments_history SET user_id = 0 WHERE user_id = $1`,
+			`UPDATE segments_history_archive SET user_id = 0 WHERE user_id = $1`,
+		}
+	case models.ErasurePurge:
+		queries = []string{
+			`DELETE FROM segments_history WHERE user_id = $1`,
+			`DELETE FROM segments_history_archive WHERE user_id = $1`,
+		}
+	default:
+		return erasure, fmt.Errorf("%w: unknown erasure policy %s", storage.ErrInvalidData, policy)
+	}
+	for _, query := range queries {
+		tag, err = tx.Exec(ctx, query, user)
+		if err != nil {
+			return erasure, err
+		}
+		erasure.HistoryRecords += tag.RowsAffected()
+	}
+
+	// Пользователя могли не регистрировать, но членство и история по нему все равно могут остаться
+	if !found && erasure.MembershipsRemoved == 0 && erasure.HistoryRecords == 0 {
+		return erasure, storage.ErrUserNotFound
+	}
+
+	details, err := json.Marshal(erasure)
+	if err != nil {
+		return erasure, err
+	}
+	query = `	INSERT INTO audit_log (action, user_id, details, created_at)
+				VALUES ('user_erasure', $1, $2, now())`
+	_, err = tx.Exec(ctx, query, user, string(details))
+	if err != nil {
+		return erasure, err
+	}
+
+	var erasureID int64
+	query = `INSERT INTO archive_erasures (user_id, policy) VALUES ($1, $2) RETURNING id`
+	err = tx.QueryRow(ctx, query, user, string(policy)).Scan(&erasureID)
+	if err != nil {
+		return erasure, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return erasure, err
+	}
+
+	// Файлы переписываются после фиксации: пачка архива, которая уже записана в файл, но еще не удалена
+	// из базы данных, держит блокировку строк истории пользователя, поэтому к этому моменту она уже в файле
+	archived, err := s.processArchiveErasure(ctx, erasureID)
+	if err != nil {
+		s.logger.Errorw("error",
+			"DeleteUser: erasing user in archive files failed, erasure is queued ", err,
+		)
+		return erasure, nil
+	}
+	erasure.HistoryRecords += archived
+
+	s.logger.Infow("info",
+		"DeleteUser: successfully erased user: ", erasure,
+	)
+	return erasure, nil
+}
+
+func scanUser(row rowScanner) (models.User, error) {
+	var user models.User
+	var attributes []byte
+	err := row.Scan(&user.ID, &user.CreatedAt, &attributes)
+	user.Attributes = attributes
+	return user, err
+}
@@ -2,21 +2,120 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
 
 	"github.com/h3ll0kitt1/avitotest/internal/models"
 )
 
 type Storage interface {
 	// segment
-	CreateSegment(ctx context.Context, slug string, PercentageRND int) error
+	CreateSegment(ctx context.Context, segment models.SegmentInfo, PercentageRND int) (models.CreateSegmentResult, error)
+	UpdateSegment(ctx context.Context, slug string, patch models.SegmentPatch) (models.SegmentInfo, error)
+	GetSegment(ctx context.Context, slug string) (models.SegmentInfo, error)
+	GetSegments(ctx context.Context, tag string) ([]models.SegmentInfo, error)
 	DeleteSegment(ctx context.Context, slug string) error
+	RenameSegment(ctx context.Context, slug string, newSlug string) error
+	RestoreSegment(ctx context.Context, slug string) error
+	RecomputeSegment(ctx context.Context, slug string) (models.RecomputeResult, error)
 
 	// users-segments
 	GetSegmentsByUserID(ctx context.Context, user int64) ([]models.Segment, error)
-	UpdateSegmentsByUserID(ctx context.Context, user int64, deleteList []models.Segment, addList []models.Segment) error
+	GetSegmentsByUserIDs(ctx context.Context, users []int64) (map[int64][]models.Segment, error)
+	GetMembership(ctx context.Context, user int64, slug string) (models.Membership, error)
+	UpdateSegmentsByUserID(ctx context.Context, user int64, deleteList []models.Segment, addList []models.Segment, strict bool) (models.UpdateResult, error)
+	UpdateSegmentsBatch(ctx context.Context, operations []models.BatchOperation, strict bool, partial bool) ([]models.BatchItemResult, error)
+
+	// users
+	CreateUser(ctx context.Context, user int64, attributes json.RawMessage) (models.CreateUserResult, error)
+	UpdateUserAttributes(ctx context.Context, user int64, attributes json.RawMessage, merge bool) (models.User, error)
+	ImportUsers(ctx context.Context, users []int64) (models.UserImportResult, error)
+	GetUser(ctx context.Context, user int64) (models.User, error)
+	GetUsers(ctx context.Context, after int64, limit int) ([]models.User, error)
+	DeleteUser(ctx context.Context, user int64, policy models.ErasurePolicy) (models.UserErasure, error)
+
+	// import
+	CreateImportJob(ctx context.Context, slug string, mode models.ImportMode, totalRows int) (models.ImportJob, error)
+	GetImportJob(ctx context.Context, slug string, id int64) (models.ImportJob, error)
+	RunImportJob(job models.ImportJob, rows []models.ImportRow)
 
 	// history
-	GetHistory(ctx context.Context, users []int64, days int) ([]models.History, error)
+	GetHistory(ctx context.Context, filter models.HistoryFilter) ([]models.History, error)
+
+	// idempotency
+	ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, bool, error)
+	SaveIdempotencyResponse(ctx context.Context, key string, statusCode int, body []byte) error
+	DeleteIdempotencyKey(ctx context.Context, key string) error
+
+	DeleteExpiredSegments() []int64
+	DeleteExpiredIdempotencyKeys()
+	FailStaleImportJobs()
+	PurgeArchivedSegments(grace time.Duration)
+	CreateHistoryPartitions()
+	ArchiveHistory()
+	RecomputeRuleSegments() []int64
+}
+
+// UnknownSegmentsError возвращается в строгом режиме, если пользователя пытаются добавить в несуществующие сегменты
+type UnknownSegmentsError struct {
+	Slugs []string
+}
+
+func (e *UnknownSegmentsError) Error() string {
+	return "unknown segments: " + strings.Join(e.Slugs, ", ")
+}
+
+// CompositionCycleError возвращается, если сегмент прямо или через другие составные сегменты входит в собственный состав.
+// Cycle - цепочка сегментов от изменяемого сегмента обратно к нему
+type CompositionCycleError struct {
+	Cycle []string
+}
+
+func (e *CompositionCycleError) Error() string {
+	return "composition cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// CompositeSegmentsError возвращается, если пользователей пытаются явно добавить в составные сегменты,
+// членство в которых только вычисляется из их состава
+type CompositeSegmentsError struct {
+	Slugs []string
+}
+
+func (e *CompositeSegmentsError) Error() string {
+	return "composite segments: " + strings.Join(e.Slugs, ", ")
+}
+
+var (
+	ErrSegmentNotFound = errors.New("storage: segment not found")
+	ErrSegmentExists   = errors.New("storage: segment already exists")
+	ErrSegmentArchived = errors.New("storage: segment is archived")
+	ErrUserNotFound    = errors.New("storage: user not found")
+	ErrImportNotFound  = errors.New("storage: import job not found")
+)
+
+// Ошибки хранилища, не зависящие от конкретной СУБД
+var (
+	ErrConflict    = errors.New("storage: conflict with current state of data")
+	ErrInvalidData = errors.New("storage: data violates constraints")
+	ErrUnavailable = errors.New("storage: temporarily unavailable")
+)
+
+// Error сохраняет исходную ошибку СУБД и позволяет сравнить ее с одной из общих ошибок через errors.Is
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
 
-	DeleteExpiredSegments()
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
 }
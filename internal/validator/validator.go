@@ -1,70 +1,390 @@
 package validator
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
 	"regexp"
+	"unicode/utf8"
 
 	"github.com/h3ll0kitt1/avitotest/internal/models"
+	"github.com/h3ll0kitt1/avitotest/internal/rules"
 )
 
+// Violation описывает одно нарушенное правило: путь до поля, название правила,
+// переданное значение и понятное человеку сообщение
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Value   any    `json:"value"`
+	Message string `json:"message"`
+}
+
+type Violations []Violation
+
 type Validator interface {
-	UserId(user int64) bool
-	Days(days int) bool
-	PercentageRND(percentageRND int) bool
-	SegmentSlug(slug string) bool
-	Segments(segments []models.Segment) bool
+	UserId(field string, user int64) Violations
+	Days(field string, days int) Violations
+	PercentageRND(field string, percentageRND int) Violations
+	PercentageComposition(field string, percentageRND int, composition *models.Composition) Violations
+	SegmentSlug(field string, slug string) Violations
+	Segments(field string, segments []models.Segment) Violations
+	SegmentInfo(segment models.SegmentInfo) Violations
+	SegmentPatch(patch models.SegmentPatch) Violations
+	ImportRows(field string, rows []models.ImportRow) Violations
+	Page(after int64, limit int) Violations
+	UserAttributes(field string, attributes json.RawMessage) Violations
 }
 
 type DefaultValidator struct {
-	SegmentSlugExpr string
-	MaxHistoryDays  int
-	MaxTTLDays      int
+	SegmentSlugExpr      string
+	MaxHistoryDays       int
+	MaxTTLDays           int
+	MaxDescriptionLength int
+	MaxOwnerLength       int
+	MaxTags              int
+	MaxTagLength         int
+	MaxPageSize          int
+	MaxRuleLength        int
+	MaxComposition       int
 }
 
 func New() *DefaultValidator {
 	regularExpr := `^[a-zA-Z0-9_]*$`
 
 	return &DefaultValidator{
-		SegmentSlugExpr: regularExpr,
-		MaxHistoryDays:  5000,
-		MaxTTLDays:      5000,
+		SegmentSlugExpr:      regularExpr,
+		MaxHistoryDays:       5000,
+		MaxTTLDays:           5000,
+		MaxDescriptionLength: 1024,
+		MaxOwnerLength:       255,
+		MaxTags:              32,
+		MaxTagLength:         64,
+		MaxPageSize:          1000,
+		MaxRuleLength:        1024,
+		MaxComposition:       32,
 	}
 }
 
-func (v *DefaultValidator) UserId(user int64) bool {
-	if user >= 1 {
-		return true
+// Идентификаторы пользователей хранятся в колонках integer, поэтому больший идентификатор
+// отклоняем при проверке, а не ошибкой базы данных
+func (v *DefaultValidator) UserId(field string, user int64) Violations {
+	if user < 1 {
+		return Violations{minViolation(field, user, 1)}
 	}
-	return false
+	if user > math.MaxInt32 {
+		return Violations{maxViolation(field, user, math.MaxInt32)}
+	}
+	return nil
 }
 
-func (v *DefaultValidator) Days(days int) bool {
-	if days >= 1 && days <= v.MaxHistoryDays {
-		return true
+func (v *DefaultValidator) Days(field string, days int) Violations {
+	if days < 1 {
+		return Violations{minViolation(field, days, 1)}
+	}
+	if days > v.MaxHistoryDays {
+		return Violations{maxViolation(field, days, v.MaxHistoryDays)}
 	}
-	return false
+	return nil
 }
 
-func (v *DefaultValidator) PercentageRND(percentageRND int) bool {
-	if percentageRND >= 0 && percentageRND <= 100 {
-		return true
+func (v *DefaultValidator) PercentageRND(field string, percentageRND int) Violations {
+	if percentageRND < 0 {
+		return Violations{minViolation(field, percentageRND, 0)}
 	}
-	return false
+	if percentageRND > 100 {
+		return Violations{maxViolation(field, percentageRND, 100)}
+	}
+	return nil
 }
 
-func (v *DefaultValidator) SegmentSlug(slug string) bool {
-	re := regexp.MustCompile(v.SegmentSlugExpr)
-	return re.MatchString(slug)
+// Членство в составном сегменте только вычисляется, поэтому случайных пользователей в него добавить нельзя
+func (v *DefaultValidator) PercentageComposition(field string, percentageRND int, composition *models.Composition) Violations {
+	if percentageRND != 0 && hasComposition(composition) {
+		return Violations{exclusiveViolation(field, "composition")}
+	}
+	return nil
 }
 
-func (v *DefaultValidator) Segments(segments []models.Segment) bool {
+func (v *DefaultValidator) SegmentSlug(field string, slug string) Violations {
 	re := regexp.MustCompile(v.SegmentSlugExpr)
-	for _, segment := range segments {
-		if !re.MatchString(segment.Slug) {
-			return false
+	if !re.MatchString(slug) {
+		return Violations{{
+			Field:   field,
+			Rule:    "pattern",
+			Value:   slug,
+			Message: field + " may contain only latin letters, digits and underscore",
+		}}
+	}
+	return nil
+}
+
+func (v *DefaultValidator) Segments(field string, segments []models.Segment) Violations {
+	var violations Violations
+	for i, segment := range segments {
+		prefix := fmt.Sprintf("%s[%d]", field, i)
+
+		violations = append(violations, v.SegmentSlug(prefix+".segment_slug", segment.Slug)...)
+
+		if segment.DaysTTL < 0 {
+			violations = append(violations, minViolation(prefix+".days_ttl", segment.DaysTTL, 0))
+		}
+		if segment.DaysTTL > v.MaxTTLDays {
+			violations = append(violations, maxViolation(prefix+".days_ttl", segment.DaysTTL, v.MaxTTLDays))
+		}
+	}
+	return violations
+}
+
+func (v *DefaultValidator) SegmentInfo(segment models.SegmentInfo) Violations {
+	var violations Violations
+	violations = append(violations, v.text("description", segment.Description, v.MaxDescriptionLength)...)
+	violations = append(violations, v.text("owner", segment.Owner, v.MaxOwnerLength)...)
+	violations = append(violations, v.tags("tags", segment.Tags)...)
+	violations = append(violations, v.attributes("attributes", segment.Attributes)...)
+	violations = append(violations, v.rule("rule", segment.Rule)...)
+	violations = append(violations, v.composition("composition", segment.Composition)...)
+	if segment.Rule != "" && hasComposition(segment.Composition) {
+		violations = append(violations, exclusiveViolation("composition", "rule"))
+	}
+	return violations
+}
+
+func (v *DefaultValidator) SegmentPatch(patch models.SegmentPatch) Violations {
+	var violations Violations
+	if patch.Description != nil {
+		violations = append(violations, v.text("description", *patch.Description, v.MaxDescriptionLength)...)
+	}
+	if patch.Owner != nil {
+		violations = append(violations, v.text("owner", *patch.Owner, v.MaxOwnerLength)...)
+	}
+	if patch.Tags != nil {
+		violations = append(violations, v.tags("tags", *patch.Tags)...)
+	}
+	if patch.Attributes != nil {
+		violations = append(violations, v.attributes("attributes", *patch.Attributes)...)
+	}
+	if patch.Rule != nil {
+		violations = append(violations, v.rule("rule", *patch.Rule)...)
+	}
+	violations = append(violations, v.composition("composition", patch.Composition)...)
+	if patch.Rule != nil && *patch.Rule != "" && hasComposition(patch.Composition) {
+		violations = append(violations, exclusiveViolation("composition", "rule"))
+	}
+	return violations
+}
+
+func (v *DefaultValidator) ImportRows(field string, rows []models.ImportRow) Violations {
+	var violations Violations
+	for _, row := range rows {
+		prefix := fmt.Sprintf("%s[%d]", field, row.Line)
+
+		violations = append(violations, v.UserId(prefix+".user_id", row.User)...)
+
+		if row.DaysTTL < 0 {
+			violations = append(violations, minViolation(prefix+".days_ttl", row.DaysTTL, 0))
+		}
+		if row.DaysTTL > v.MaxTTLDays {
+			violations = append(violations, maxViolation(prefix+".days_ttl", row.DaysTTL, v.MaxTTLDays))
+		}
+	}
+	return violations
+}
+
+// Страница списка задается последним идентификатором предыдущей страницы и размером страницы
+func (v *DefaultValidator) Page(after int64, limit int) Violations {
+	var violations Violations
+	if after < 0 {
+		violations = append(violations, minViolation("after", after, 0))
+	}
+	if limit < 1 {
+		violations = append(violations, minViolation("limit", limit, 1))
+	}
+	if limit > v.MaxPageSize {
+		violations = append(violations, maxViolation("limit", limit, v.MaxPageSize))
+	}
+	return violations
+}
+
+// Атрибуты пользователя обязательны и должны быть JSON объектом
+func (v *DefaultValidator) UserAttributes(field string, attributes json.RawMessage) Violations {
+	trimmed := bytes.TrimSpace(attributes)
+	if len(trimmed) != 0 && trimmed[0] == '{' {
+		return nil
+	}
+	return Violations{{
+		Field:   field,
+		Rule:    "type",
+		Value:   string(trimmed),
+		Message: field + " must be a JSON object",
+	}}
+}
+
+func (v *DefaultValidator) text(field string, value string, maxLength int) Violations {
+	if utf8.RuneCountInString(value) > maxLength {
+		return Violations{{
+			Field:   field,
+			Rule:    "max_length",
+			Value:   value,
+			Message: fmt.Sprintf("%s exceeds %d characters", field, maxLength),
+		}}
+	}
+	return nil
+}
+
+func (v *DefaultValidator) tags(field string, tags []string) Violations {
+	if len(tags) > v.MaxTags {
+		return Violations{{
+			Field:   field,
+			Rule:    "max_items",
+			Value:   len(tags),
+			Message: fmt.Sprintf("%s exceeds %d items", field, v.MaxTags),
+		}}
+	}
+
+	var violations Violations
+	for i, tag := range tags {
+		tagField := fmt.Sprintf("%s[%d]", field, i)
+		if tag == "" {
+			violations = append(violations, Violation{
+				Field:   tagField,
+				Rule:    "required",
+				Value:   tag,
+				Message: tagField + " must not be empty",
+			})
+		}
+		violations = append(violations, v.text(tagField, tag, v.MaxTagLength)...)
+	}
+	return violations
+}
+
+// Атрибуты сегмента - произвольный JSON объект
+func (v *DefaultValidator) attributes(field string, attributes json.RawMessage) Violations {
+	trimmed := bytes.TrimSpace(attributes)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) || trimmed[0] == '{' {
+		return nil
+	}
+	return Violations{{
+		Field:   field,
+		Rule:    "type",
+		Value:   string(trimmed),
+		Message: field + " must be a JSON object",
+	}}
+}
+
+// Пустое правило означает обычный сегмент без правила
+func (v *DefaultValidator) rule(field string, rule string) Violations {
+	if rule == "" {
+		return nil
+	}
+	violations := v.text(field, rule, v.MaxRuleLength)
+	if len(violations) != 0 {
+		return violations
+	}
+
+	_, err := rules.Parse(rule)
+	if err != nil {
+		return Violations{{
+			Field:   field,
+			Rule:    "syntax",
+			Value:   rule,
+			Message: field + ": " + err.Error(),
+		}}
+	}
+	return nil
+}
+
+// Состав без операции и сегментов означает обычный сегмент без состава. Для любой операции нужно
+// не меньше двух сегментов, сегменты не повторяются
+func (v *DefaultValidator) composition(field string, composition *models.Composition) Violations {
+	if !hasComposition(composition) {
+		return nil
+	}
+
+	var violations Violations
+	switch composition.Operation {
+	case models.SetUnion, models.SetIntersect, models.SetDifference:
+	default:
+		violations = append(violations, Violation{
+			Field:   field + ".operation",
+			Rule:    "enum",
+			Value:   composition.Operation,
+			Message: field + ".operation must be one of union, intersect, difference",
+		})
+	}
+
+	segmentsField := field + ".segments"
+	if len(composition.Segments) < 2 {
+		violations = append(violations, Violation{
+			Field:   segmentsField,
+			Rule:    "min_items",
+			Value:   len(composition.Segments),
+			Message: segmentsField + " must contain at least 2 items",
+		})
+	}
+	if len(composition.Segments) > v.MaxComposition {
+		violations = append(violations, Violation{
+			Field:   segmentsField,
+			Rule:    "max_items",
+			Value:   len(composition.Segments),
+			Message: fmt.Sprintf("%s exceeds %d items", segmentsField, v.MaxComposition),
+		})
+	}
+
+	seen := make(map[string]bool, len(composition.Segments))
+	for i, slug := range composition.Segments {
+		slugField := fmt.Sprintf("%s[%d]", segmentsField, i)
+		if slug == "" {
+			violations = append(violations, Violation{
+				Field:   slugField,
+				Rule:    "required",
+				Value:   slug,
+				Message: slugField + " must not be empty",
+			})
+			continue
 		}
-		if segment.DaysTTL < 0 || segment.DaysTTL > v.MaxTTLDays {
-			return false
+		violations = append(violations, v.SegmentSlug(slugField, slug)...)
+		if seen[slug] {
+			violations = append(violations, Violation{
+				Field:   slugField,
+				Rule:    "unique",
+				Value:   slug,
+				Message: slugField + " duplicates another segment",
+			})
 		}
+		seen[slug] = true
+	}
+	return violations
+}
+
+func hasComposition(composition *models.Composition) bool {
+	return composition != nil && (composition.Operation != "" || len(composition.Segments) != 0)
+}
+
+func exclusiveViolation(field string, other string) Violation {
+	return Violation{
+		Field:   field,
+		Rule:    "exclusive",
+		Value:   nil,
+		Message: field + " can not be used together with " + other,
+	}
+}
+
+func minViolation(field string, value any, limit int) Violation {
+	return Violation{
+		Field:   field,
+		Rule:    "min",
+		Value:   value,
+		Message: fmt.Sprintf("%s must be at least %d", field, limit),
+	}
+}
+
+func maxViolation(field string, value any, limit int) Violation {
+	return Violation{
+		Field:   field,
+		Rule:    "max",
+		Value:   value,
+		Message: fmt.Sprintf("%s exceeds %d", field, limit),
 	}
-	return true
 }
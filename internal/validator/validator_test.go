@@ -0,0 +1,37 @@
+package validator
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUserId(t *testing.T) {
+	v := New()
+
+	tests := []struct {
+		name string
+		user int64
+		rule string
+	}{
+		{"zero", 0, "min"},
+		{"negative", -1, "min"},
+		{"first", 1, ""},
+		{"max integer", math.MaxInt32, ""},
+		{"exceeds integer column", math.MaxInt32 + 1, "max"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := v.UserId("user_id", tt.user)
+			if tt.rule == "" {
+				if len(violations) != 0 {
+					t.Errorf("unexpected violations %v", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || violations[0].Rule != tt.rule {
+				t.Errorf("violations = %v, want rule %s", violations, tt.rule)
+			}
+		})
+	}
+}